@@ -0,0 +1,83 @@
+package sqlwrapper
+
+import (
+	"strconv"
+
+	"gorm.io/gorm/clause"
+)
+
+// limitWithTies replaces the LIMIT clause by "FETCH FIRST n ROWS WITH TIES"
+type limitWithTies struct {
+	Limit  int
+	Offset int
+}
+
+func (l limitWithTies) Name() string {
+	return "LIMIT"
+}
+
+func (l limitWithTies) Build(builder clause.Builder) {
+	if l.Offset > 0 {
+		builder.WriteString("OFFSET ")
+		builder.WriteString(strconv.Itoa(l.Offset))
+		builder.WriteString(" ROWS ")
+	}
+
+	builder.WriteString("FETCH FIRST ")
+	builder.WriteString(strconv.Itoa(l.Limit))
+	builder.WriteString(" ROWS WITH TIES")
+}
+
+func (l limitWithTies) MergeClause(c *clause.Clause) {
+	// keep the offset of a previous Offset call
+	if limit, ok := c.Expression.(clause.Limit); ok && l.Offset == 0 {
+		l.Offset = limit.Offset
+	}
+
+	c.Name = ""
+	c.Expression = l
+}
+
+// with prepends the WITH list of the common table expressions to the SELECT clause
+type with struct {
+	Recursive bool
+	CTEs      []cte
+}
+
+// cte is a named common table expression, Query is a *gorm.DB subquery or a clause.Expr
+type cte struct {
+	Name  string
+	Query interface{}
+}
+
+func (w with) Name() string {
+	return "SELECT"
+}
+
+func (w with) Build(builder clause.Builder) {
+	builder.WriteString("WITH ")
+	if w.Recursive {
+		builder.WriteString("RECURSIVE ")
+	}
+
+	for i, c := range w.CTEs {
+		if i > 0 {
+			builder.WriteString(", ")
+		}
+
+		builder.WriteQuoted(c.Name)
+		builder.WriteString(" AS (")
+		builder.AddVar(builder, c.Query)
+		builder.WriteByte(')')
+	}
+}
+
+func (w with) MergeClause(c *clause.Clause) {
+	// append to the WITH list of a previous call, the list is recursive if any of them is
+	if previous, ok := c.BeforeExpression.(with); ok {
+		w.Recursive = w.Recursive || previous.Recursive
+		w.CTEs = append(append([]cte{}, previous.CTEs...), w.CTEs...)
+	}
+
+	c.BeforeExpression = w
+}
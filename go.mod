@@ -4,21 +4,25 @@ go 1.19
 
 require (
 	github.com/fatih/color v1.15.0
+	github.com/go-sql-driver/mysql v1.7.0
+	github.com/jackc/pgx/v5 v5.4.3
 	github.com/mindwingx/abstraction v0.0.0-20231011012716-8269fe5924ae
 	github.com/mindwingx/go-helper v0.0.0-20230823115142-6448921aaddd
-	gorm.io/driver/postgres v1.5.2
+	gorm.io/driver/mysql v1.5.1
+	gorm.io/driver/postgres v1.5.3
+	gorm.io/driver/sqlite v1.5.3
 	gorm.io/gorm v1.25.4
 )
 
 require (
 	github.com/jackc/pgpassfile v1.0.0 // indirect
 	github.com/jackc/pgservicefile v0.0.0-20221227161230-091c0ba34f0a // indirect
-	github.com/jackc/pgx/v5 v5.3.1 // indirect
 	github.com/jinzhu/inflection v1.0.0 // indirect
 	github.com/jinzhu/now v1.1.5 // indirect
 	github.com/mattn/go-colorable v0.1.13 // indirect
 	github.com/mattn/go-isatty v0.0.17 // indirect
-	golang.org/x/crypto v0.8.0 // indirect
-	golang.org/x/sys v0.7.0 // indirect
+	github.com/mattn/go-sqlite3 v1.14.17 // indirect
+	golang.org/x/crypto v0.9.0 // indirect
+	golang.org/x/sys v0.8.0 // indirect
 	golang.org/x/text v0.12.0 // indirect
 )
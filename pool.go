@@ -0,0 +1,32 @@
+package sqlwrapper
+
+import (
+	"context"
+	SdkSql "database/sql"
+
+	"github.com/jackc/pgx/v5"
+	"gorm.io/gorm"
+)
+
+// simpleProtocolPool runs the statements of the pool by the pgx simple protocol,
+// so they aren't prepared and their plans aren't cached on the server
+type simpleProtocolPool struct {
+	gorm.ConnPool
+}
+
+func (p simpleProtocolPool) ExecContext(ctx context.Context, query string, args ...interface{}) (SdkSql.Result, error) {
+	return p.ConnPool.ExecContext(ctx, query, simpleProtocolArgs(args)...)
+}
+
+func (p simpleProtocolPool) QueryContext(ctx context.Context, query string, args ...interface{}) (*SdkSql.Rows, error) {
+	return p.ConnPool.QueryContext(ctx, query, simpleProtocolArgs(args)...)
+}
+
+func (p simpleProtocolPool) QueryRowContext(ctx context.Context, query string, args ...interface{}) *SdkSql.Row {
+	return p.ConnPool.QueryRowContext(ctx, query, simpleProtocolArgs(args)...)
+}
+
+// simpleProtocolArgs prepends the exec mode to the args, pgx takes it from the first arg
+func simpleProtocolArgs(args []interface{}) []interface{} {
+	return append([]interface{}{pgx.QueryExecModeSimpleProtocol}, args...)
+}
@@ -0,0 +1,79 @@
+package sqlwrapper
+
+import (
+	"strings"
+	"sync"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// slowQueriesLimit bounds the queries slowQueries remembers as passed to onSlow
+const slowQueriesLimit = 1000
+
+// slowQueryStartKey is the InstanceSet key of the start time of a query
+const slowQueryStartKey = "sqlwrapper:slow_query_start"
+
+// slowQueries passes the slow SELECT (and WITH) queries to onSlow, once per query, as
+// the sql of the statement with its placeholders and the vars bound to them. onSlow
+// runs on a goroutine of its own, off the connection and the transaction of the query
+type slowQueries struct {
+	threshold time.Duration
+	onSlow    func(query string, vars []interface{})
+	seen      *seenQueries
+}
+
+// seenQueries is a set of up to limit queries, the oldest is dropped first
+type seenQueries struct {
+	mu      sync.Mutex
+	limit   int
+	queries map[string]struct{}
+	order   []string
+}
+
+func newSeenQueries(limit int) *seenQueries {
+	return &seenQueries{limit: limit, queries: make(map[string]struct{}, limit)}
+}
+
+// add reports whether the query is a new one
+func (s *seenQueries) add(query string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, seen := s.queries[query]; seen {
+		return false
+	}
+
+	if len(s.order) >= s.limit {
+		delete(s.queries, s.order[0])
+		s.order = s.order[1:]
+	}
+
+	s.queries[query] = struct{}{}
+	s.order = append(s.order, query)
+
+	return true
+}
+
+// start records the start time of the query, before it runs
+func (s slowQueries) start(db *gorm.DB) {
+	db.InstanceSet(slowQueryStartKey, time.Now())
+}
+
+// check passes the query to onSlow if it ran for threshold at least
+func (s slowQueries) check(db *gorm.DB) {
+	begin, ok := db.InstanceGet(slowQueryStartKey)
+	if !ok || db.Error != nil || db.DryRun || time.Since(begin.(time.Time)) < s.threshold {
+		return
+	}
+
+	query := db.Statement.SQL.String()
+	if statement := strings.ToUpper(strings.TrimSpace(query)); !strings.HasPrefix(statement, "SELECT") && !strings.HasPrefix(statement, "WITH") {
+		return
+	}
+
+	if s.seen.add(query) {
+		vars := append([]interface{}(nil), db.Statement.Vars...)
+		go s.onSlow(query, vars)
+	}
+}
@@ -0,0 +1,73 @@
+package sqlwrapper
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSeenQueriesDropsTheOldest(t *testing.T) {
+	seen := newSeenQueries(2)
+
+	for _, query := range []string{"a", "b", "c"} {
+		if !seen.add(query) {
+			t.Fatalf("%q is taken as seen", query)
+		}
+	}
+
+	if seen.add("c") {
+		t.Fatal("c is taken as new")
+	}
+
+	if !seen.add("a") {
+		t.Fatal("a is remembered beyond the limit")
+	}
+
+	if len(seen.queries) != 2 || len(seen.order) != 2 {
+		t.Fatalf("remembers %d queries, want 2", len(seen.queries))
+	}
+}
+
+func TestSlowQueriesPassTheVarsApart(t *testing.T) {
+	g := newTestSql(t, dbConfig{})
+	migrateTest(t, g, &testUser{})
+
+	type explained struct {
+		query string
+		vars  []interface{}
+	}
+
+	release, slow := make(chan struct{}), make(chan explained, 2)
+	g.watchSlowQueries(slowQueries{
+		onSlow: func(query string, vars []interface{}) {
+			<-release
+			slow <- explained{query: query, vars: vars}
+		},
+		seen: newSeenQueries(slowQueriesLimit),
+	})
+
+	// the queries return while onSlow is blocked, as an EXPLAIN waiting for a connection
+	name := "a'); DROP TABLE users; --"
+	for i := 0; i < 2; i++ {
+		if err := g.Session().Where("name = ?", name).Find(&[]testUser{}).Error(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	close(release)
+
+	select {
+	case got := <-slow:
+		if strings.Contains(got.query, "DROP") || len(got.vars) != 1 || got.vars[0] != name {
+			t.Fatalf("explained %q with %v, want the arg as a var", got.query, got.vars)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("onSlow didn't run")
+	}
+
+	select {
+	case got := <-slow:
+		t.Fatalf("explained %q twice", got.query)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
@@ -1,29 +1,252 @@
 package sqlwrapper
 
 import (
+	"context"
 	SdkSql "database/sql"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"github.com/fatih/color"
+	MysqlDriver "github.com/go-sql-driver/mysql"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/stdlib"
 	"github.com/mindwingx/abstraction"
 	"github.com/mindwingx/go-helper"
+	"gorm.io/driver/mysql"
 	"gorm.io/driver/postgres"
+	"gorm.io/driver/sqlite"
 	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
 	"gorm.io/gorm/logger"
+	"gorm.io/gorm/schema"
 	"io/ioutil"
 	"log"
+	"math/rand"
+	"net"
 	"os"
+	"reflect"
 	"sort"
+	"strings"
+	"sync"
 	"time"
 )
 
+// AuditActorKey is the Set key of the actor reported by the audit events
+const AuditActorKey = "sqlwrapper:audit_actor"
+
+// the row lock strengths of Lock, LockNoKeyUpdate doesn't block the foreign key
+// checks of the other transactions, unlike LockUpdate
+const (
+	LockUpdate      = "UPDATE"
+	LockNoKeyUpdate = "NO KEY UPDATE"
+	LockShare       = "SHARE"
+	LockKeyShare    = "KEY SHARE"
+)
+
+// suggestIndexMinRows is the estimated rows of a table from which SuggestIndexes
+// reports its sequential scans
+const suggestIndexMinRows = 10000
+
+// explainTimeout bounds the EXPLAIN of a slow query, which runs detached from the query
+const explainTimeout = 30 * time.Second
+
+// maxLifetimeJitterPercent bounds the MaxLifetimeJitterPercent config
+const maxLifetimeJitterPercent = 99
+
+// migrationsTable records the files applied by Migrate
+const migrationsTable = "schema_migrations"
+
+// preserveTimestampsKey is the Set key of a PreserveTimestamps chain
+const preserveTimestampsKey = "sqlwrapper:preserve_timestamps"
+
+// lastSqlKey is the InstanceSet key of the sql executed by a statement
+const lastSqlKey = "sqlwrapper:last_sql"
+
+// capturingKey is the Set key of the DryRun render of UpdateCapturing
+const capturingKey = "sqlwrapper:capturing"
+
+// uncappedKey is the Set key of the queries MaxResultRows doesn't cap, the internal
+// reads and the preloads of a query, which inherit it from the query
+const uncappedKey = "sqlwrapper:uncapped"
+
+// scanKey is the Set key of a Scan, the rows statement MaxResultRows caps, the Row
+// and the Rows statements are read by the caller row by row
+const scanKey = "sqlwrapper:scan"
+
+// cappedKey is the InstanceSet key of a query capped by capResultRows
+const cappedKey = "sqlwrapper:capped"
+
+var (
+	ErrInvalidInterval     = errors.New("invalid time bucket interval")
+	ErrOutboxNotConfigured = errors.New("outbox table isn't configured")
+	ErrIsolationLevel      = errors.New("unknown isolation level")
+	ErrFilterOperator      = errors.New("unsupported filter operator")
+	ErrSortColumn          = errors.New("column isn't allowed to sort by")
+	ErrUnknownDriver       = errors.New("unknown database driver")
+	ErrLockStrength        = errors.New("unknown lock strength")
+	ErrLockOption          = errors.New("unknown lock option")
+	ErrLimitWithTies       = errors.New("limit with ties is supported by postgres only")
+	ErrLockTimeout         = errors.New("lock timeout must be positive")
+	ErrResultRows          = errors.New("query returns more rows than MaxResultRows")
+	ErrNotSoftDeleted      = errors.New("model has no gorm.DeletedAt field")
+)
+
+// timeBucketIntervals are the date_trunc fields accepted by TimeBucket
+var timeBucketIntervals = map[string]bool{
+	"microseconds": true,
+	"milliseconds": true,
+	"second":       true,
+	"minute":       true,
+	"hour":         true,
+	"day":          true,
+	"week":         true,
+	"month":        true,
+	"quarter":      true,
+	"year":         true,
+	"decade":       true,
+	"century":      true,
+	"millennium":   true,
+}
+
 type (
+	// Sql extends abstraction.Sql by the wrapper specific methods
+	Sql interface {
+		abstraction.Sql
+		Columns() ([]ColumnInfo, error)
+		WhereIf(cond bool, query interface{}, args ...interface{}) abstraction.Sql
+		FirstOrCreateWithFlag(out interface{}, where ...interface{}) (created bool, err error)
+		CreateInBatches(value interface{}, batchSize int) abstraction.Sql
+		SkipHooks() abstraction.Sql
+		DeferConstraints() abstraction.Sql
+		WhichExist(model interface{}, column string, values []interface{}) ([]interface{}, error)
+		SelectCase(cases []Case, elseVal, alias string, args ...interface{}) abstraction.Sql
+		LastSQL() (query string, args []interface{})
+		CountWhere(model interface{}, query interface{}, args ...interface{}) (int64, error)
+		Analyze(tables ...string) error
+		VacuumAnalyze(tables ...string) error
+		CreatePartialIndex(table, name, columns, whereClause string) error
+		LimitWithTies(n int) abstraction.Sql
+		WithLockTimeout(d time.Duration) abstraction.Sql
+		JoinPreload(assoc string, conditions ...interface{}) abstraction.Sql
+		FirstOrNil(out interface{}, where ...interface{}) (found bool, err error)
+		WithDefaults(columns ...string) abstraction.Sql
+		InTransaction() bool
+		SetJoinTableOnDelete(model interface{}, column string, handler interface{}, onDelete string) error
+		Prepared(query func(q abstraction.Sql) abstraction.Sql) abstraction.Sql
+		ReplicaLag() (time.Duration, error)
+		GroupRollup(columns ...string) abstraction.Sql
+		GroupCube(columns ...string) abstraction.Sql
+		GroupingSets(sets [][]string) abstraction.Sql
+		PurgeTrashed(model interface{}, olderThan time.Time) (int64, error)
+		WhereGroup(fn func(q abstraction.Sql) abstraction.Sql) abstraction.Sql
+		Truncate(restartIdentity bool, tables ...string) error
+		ResetSequence(table, column string) error
+		ToSQL(query func(q abstraction.Sql) abstraction.Sql) string
+		TimeBucket(column, interval, alias string) abstraction.Sql
+		Dialect() string
+		With(name string, subquery abstraction.Sql) abstraction.Sql
+		WithRecursive(name, anchorSQL, recursiveSQL string, args ...interface{}) abstraction.Sql
+		AutoMigrateInSchema(schema string, values ...interface{}) error
+		UpdateCapturing(model interface{}, values interface{}, dest *[]map[string]interface{}) error
+		UpdateSnapshot(model interface{}, values interface{}, before, after *[]map[string]interface{}) error
+		WithOutbox(fc func(tx abstraction.Sql) error, events ...OutboxEvent) error
+		Partition(name string) abstraction.Sql
+		Upsert(value interface{}, conflictColumns ...string) abstraction.Sql
+		OnMigrationProgress(fn func(file string, index, total int))
+		CreateEnum(name string, values []string) error
+		AddEnumValue(name, value string) error
+		OnConflictUpdateExpr(columns []string, assignments map[string]string) abstraction.Sql
+		PreserveTimestamps() abstraction.Sql
+		SimpleProtocol() abstraction.Sql
+		ApplyFilters(filters []Filter) abstraction.Sql
+		ApplySort(spec string, allowed []string) abstraction.Sql
+		ReplaceAssociation(model interface{}, column string, values interface{}) error
+		Lock(strength, option string) abstraction.Sql
+		SuggestIndexes(threshold time.Duration)
+		Session() abstraction.Sql
+		WithContext(ctx context.Context) abstraction.Sql
+		Transaction(fc func(tx abstraction.Sql) error, opts ...*SdkSql.TxOptions) error
+	}
+
+	// ColumnInfo describes a column of a query result
+	ColumnInfo struct {
+		Name          string
+		DatabaseType  string
+		Nullable      bool
+		NullableKnown bool // false if the driver doesn't report the nullability
+	}
+
+	// Case is a WHEN ... THEN ... branch of a CASE expression
+	Case struct {
+		When string
+		Then string
+	}
+
+	// AuditEvent describes a successful write
+	AuditEvent struct {
+		Table        string
+		Operation    string        // create, update or delete
+		Keys         []interface{} // primary keys of the written models, if known
+		RowsAffected int64
+		Actor        interface{} // value set by Set(AuditActorKey, actor) on the chain
+	}
+
+	// Filter is a condition of ApplyFilters, Op is one of eq, ne, gt, gte, lt, lte, like
+	// and in; the Value of in is a slice
+	Filter struct {
+		Field string
+		Op    string
+		Value interface{}
+	}
+
+	// OutboxEvent is a row of the outbox table, written by WithOutbox
+	OutboxEvent struct {
+		Topic   string
+		Key     string
+		Payload interface{} // marshaled to JSON
+	}
+
+	// Option customizes the sql instance on construction
+	Option func(*sql)
+
 	sql struct {
-		config dbConfig
-		locale abstraction.Locale
-		db     *gorm.DB
+		config       dbConfig
+		locale       abstraction.Locale
+		logger       logger.Interface
+		auditSink    func(AuditEvent)
+		audits       *auditBuffer
+		rowsObserver func(table string, rows int64)
+		afterConnect func(ctx context.Context, conn *pgx.Conn) error
+		// migrationProgress runs before each migration file, set by OnMigrationProgress
+		migrationProgress func(file string, index, total int)
+		db                *gorm.DB
+	}
+
+	// auditBuffer holds the audit events of the transactions opened by the wrapper
+	// until their commit
+	auditBuffer struct {
+		mu     sync.Mutex
+		events map[gorm.ConnPool][]AuditEvent
+	}
+
+	// statement is the executed sql and its args
+	statement struct {
+		query string
+		args  []interface{}
+	}
+
+	// planNode is a node of the json plan of EXPLAIN
+	planNode struct {
+		NodeType string     `json:"Node Type"`
+		Relation string     `json:"Relation Name"`
+		Filter   string     `json:"Filter"`
+		Plans    []planNode `json:"Plans"`
 	}
 
 	dbConfig struct {
+		// Driver is postgres, mysql or sqlite, postgres if empty. the Database of
+		// sqlite is the path of its file
+		Driver             string
 		Debug              bool
 		Host               string
 		Port               string
@@ -34,12 +257,43 @@ type (
 		MaxIdleConnections int
 		MaxOpenConnections int
 		MaxLifetimeSeconds int
-		SlowSqlThreshold   int
+		// MaxLifetimeJitterPercent randomizes the MaxLifetimeSeconds within ±percent, up to
+		// 99. the jitter is per process: database/sql applies one lifetime to the pool,
+		// so the connections of an instance opened together still expire together
+		MaxLifetimeJitterPercent int
+		SlowSqlThreshold         int
+		CreateBatchSize          int
+		// TranslateError maps the driver errors to the portable gorm errors,
+		// e.g. gorm.ErrDuplicatedKey and gorm.ErrForeignKeyViolated
+		TranslateError bool
+		// DisableForeignKeys skips the foreign key constraints creation on AutoMigrate
+		DisableForeignKeys bool
+		// DryRun renders the statements without executing them, the migrations
+		// and the helpers DDL are printed
+		DryRun bool
+		// SkipDefaultTransaction skips the transaction gorm wraps each single write
+		// in, true if not configured
+		SkipDefaultTransaction bool
+		// OutboxTable is the table of the WithOutbox events, with the topic, key,
+		// payload(json) and created_at columns
+		OutboxTable string
+		// IsolationLevel of the default transaction of the writes, e.g. "read committed",
+		// the server default if empty
+		IsolationLevel string
+		// Metrics reports the rows returned by each query to the WithRowsObserver observer
+		Metrics bool
+		// MaxResultRows fails the queries (Find, Pluck, Scan, etc.) without a LIMIT returning
+		// more than MaxResultRows rows by ErrResultRows, at most MaxResultRows+1 rows are
+		// loaded. the Row and Rows statements aren't capped. 0 disables it
+		MaxResultRows int
 	}
 )
 
-func NewSql(registry abstraction.Registry, locale abstraction.Locale) abstraction.Sql {
-	database := new(sql)
+func NewSql(registry abstraction.Registry, locale abstraction.Locale, opts ...Option) Sql {
+	database := &sql{
+		config: dbConfig{SkipDefaultTransaction: true}, // kept unless the config sets it
+	}
+
 	err := registry.Parse(&database.config)
 	if err != nil {
 		helper.CustomPanic("", err)
@@ -47,23 +301,65 @@ func NewSql(registry abstraction.Registry, locale abstraction.Locale) abstractio
 
 	database.locale = locale
 
+	for _, opt := range opts {
+		opt(database)
+	}
+
 	return database
 }
 
+// WithLogger replaces the built-in gorm logger by l
+func WithLogger(l logger.Interface) Option {
+	return func(g *sql) {
+		g.logger = l
+	}
+}
+
+// WithAuditSink registers fn to receive an event after each successful
+// create, update and delete; the Raw and Exec statements aren't audited.
+// the events of a transaction opened by the wrapper are held until its commit, and
+// dropped on rollback
+func WithAuditSink(fn func(AuditEvent)) Option {
+	return func(g *sql) {
+		g.auditSink = fn
+		g.audits = &auditBuffer{events: make(map[gorm.ConnPool][]AuditEvent)}
+	}
+}
+
+// WithRowsObserver registers fn to receive the count of the rows returned by each
+// query and its table, e.g. for a histogram; it runs only if the Metrics is enabled
+func WithRowsObserver(fn func(table string, rows int64)) Option {
+	return func(g *sql) {
+		g.rowsObserver = fn
+	}
+}
+
+// WithAfterConnect registers fn to run on each new physical connection of the
+// pgx driver, e.g. to register the custom types or to set up the session
+func WithAfterConnect(fn func(ctx context.Context, conn *pgx.Conn) error) Option {
+	return func(g *sql) {
+		g.afterConnect = fn
+	}
+}
+
 func (g *sql) InitSql() {
-	dsn := fmt.Sprintf(
-		"host=%s user=%s password=%s dbname=%s port=%s sslmode=%s",
-		g.config.Host,
-		g.config.Username,
-		g.config.Password,
-		g.config.Database,
-		g.config.Port,
-		g.config.Ssl,
-	)
+	dialector, err := g.dialector()
+	if err != nil {
+		helper.CustomPanic(g.locale.Get("sql_open_conn_err"), err)
+	}
 
-	database, err := gorm.Open(postgres.Open(dsn), &gorm.Config{
-		SkipDefaultTransaction: true,
-		Logger:                 g.newGormLog(g.config.SlowSqlThreshold),
+	gormLogger := g.logger
+	if gormLogger == nil {
+		gormLogger = g.newGormLog(g.config.SlowSqlThreshold)
+	}
+
+	database, err := gorm.Open(dialector, &gorm.Config{
+		SkipDefaultTransaction:                   g.config.SkipDefaultTransaction,
+		CreateBatchSize:                          g.config.CreateBatchSize,
+		DisableForeignKeyConstraintWhenMigrating: g.config.DisableForeignKeys,
+		TranslateError:                           g.config.TranslateError,
+		DryRun:                                   g.config.DryRun,
+		Logger:                                   gormLogger,
 		NowFunc: func() time.Time {
 			return time.Now().UTC()
 		},
@@ -86,9 +382,11 @@ func (g *sql) InitSql() {
 	}
 
 	if g.config.MaxLifetimeSeconds != 0 {
-		sqlDatabase.SetConnMaxLifetime(time.Second * time.Duration(g.config.MaxLifetimeSeconds))
+		sqlDatabase.SetConnMaxLifetime(g.connMaxLifetime())
 	}
 
+	g.registerCallbacks(database)
+
 	if g.config.Debug {
 		database = database.Debug()
 		color.Yellow(g.locale.Get("sql_debug_enable"))
@@ -98,6 +396,7 @@ func (g *sql) InitSql() {
 }
 
 // Migrate path: migration files base path
+// the applied files are recorded in the schema_migrations table and skipped later
 func (g *sql) Migrate(path string) {
 	// Open the directory
 	dir, err := os.Open(path)
@@ -120,14 +419,100 @@ func (g *sql) Migrate(path string) {
 		return fileInfos[i].Name() < fileInfos[j].Name()
 	})
 
-	// Iterate over the file info slice and print the file names
+	files := make([]os.FileInfo, 0, len(fileInfos))
 	for _, fileInfo := range fileInfos {
 		if fileInfo.Mode().IsRegular() {
-			if err = g.db.Exec(g.parseSqlFile(path, fileInfo)).Error; err != nil {
-				helper.CustomPanic(g.locale.Get("sql_migrate_err"), err)
-			}
+			files = append(files, fileInfo)
+		}
+	}
+
+	// Skip the files recorded in the migrations table
+	applied, err := g.appliedMigrations()
+	if err != nil {
+		helper.CustomPanic(g.locale.Get("sql_migrate_err"), err)
+	}
+
+	pending := make([]os.FileInfo, 0, len(files))
+	for _, fileInfo := range files {
+		if !applied[fileInfo.Name()] {
+			pending = append(pending, fileInfo)
+		}
+	}
+
+	// Iterate over the pending sql files and apply them in order
+	appliedCount := 0
+	for index, fileInfo := range pending {
+		if g.migrationProgress != nil {
+			g.migrationProgress(fileInfo.Name(), index+1, len(pending))
+		}
+
+		if g.config.DryRun {
+			fmt.Printf("-- %s\n", fileInfo.Name())
+			g.printDryRun(g.parseSqlFile(path, fileInfo))
+			continue
+		}
+
+		if err = g.applyMigration(fileInfo.Name(), g.parseSqlFile(path, fileInfo)); err != nil {
+			helper.CustomPanic(g.locale.Get("sql_migrate_err"), err)
 		}
+
+		appliedCount++
+		color.Yellow("%s %s", g.locale.Get("sql_migration_applied"), fileInfo.Name())
+	}
+
+	color.Yellow(
+		"%s: %d, %s: %d",
+		g.locale.Get("sql_migrations_applied"), appliedCount,
+		g.locale.Get("sql_migrations_skipped"), len(files)-len(pending),
+	)
+}
+
+// appliedMigrations returns the files recorded in the migrations table, creating
+// the table if it doesn't exist. on DryRun the table isn't read, none is applied
+func (g *sql) appliedMigrations() (map[string]bool, error) {
+	applied := make(map[string]bool)
+	if g.config.DryRun {
+		return applied, nil
+	}
+
+	table := g.quoteIdentifier(migrationsTable)
+	query := fmt.Sprintf("CREATE TABLE IF NOT EXISTS %s (filename varchar(255) PRIMARY KEY, applied_at timestamp NOT NULL)", table)
+
+	if err := g.session().Exec(query).Error; err != nil {
+		return nil, err
+	}
+
+	var filenames []string
+	if err := g.session().Set(uncappedKey, true).Table(migrationsTable).Pluck("filename", &filenames).Error; err != nil {
+		return nil, err
 	}
+
+	for _, filename := range filenames {
+		applied[filename] = true
+	}
+
+	return applied, nil
+}
+
+// applyMigration runs the sql of the file and records the file in the migrations
+// table in a transaction, so a failed file is neither half applied nor recorded
+func (g *sql) applyMigration(filename, query string) error {
+	return g.transaction(g.session(), func(tx *gorm.DB) error {
+		if err := tx.Exec(query).Error; err != nil {
+			return err
+		}
+
+		return tx.Table(migrationsTable).Create(map[string]interface{}{
+			"filename":   filename,
+			"applied_at": tx.NowFunc(),
+		}).Error
+	})
+}
+
+// OnMigrationProgress registers fn to run before each file applied by Migrate,
+// index is 1-based within the pending files
+func (g *sql) OnMigrationProgress(fn func(file string, index, total int)) {
+	g.migrationProgress = fn
 }
 
 func (g *sql) Seed(items []abstraction.SeederItem) {
@@ -177,6 +562,73 @@ func (g *sql) Where(query interface{}, args ...interface{}) abstraction.Sql {
 	return g
 }
 
+// WhereIf applies the condition only if cond is true
+func (g *sql) WhereIf(cond bool, query interface{}, args ...interface{}) abstraction.Sql {
+	if cond {
+		g.db = g.db.Where(query, args...)
+	}
+
+	return g
+}
+
+// WhereGroup applies the conditions built by fn as a parenthesized group,
+// e.g. a AND (b OR c)
+func (g *sql) WhereGroup(fn func(q abstraction.Sql) abstraction.Sql) abstraction.Sql {
+	if group, ok := fn(g.clone(g.session())).(*sql); ok {
+		g.db = g.db.Where(group.db)
+	}
+
+	return g
+}
+
+// ApplyFilters adds the filters to the conditions, the fields are quoted and the
+// values bound, e.g. the filters of an api request. an unsupported operator fails the chain
+func (g *sql) ApplyFilters(filters []Filter) abstraction.Sql {
+	conditions := make([]clause.Expression, 0, len(filters))
+	for _, filter := range filters {
+		condition, err := filterCondition(filter)
+		if err != nil {
+			return g.fail(err)
+		}
+
+		conditions = append(conditions, condition)
+	}
+
+	if len(conditions) > 0 {
+		g.db = g.db.Where(clause.And(conditions...))
+	}
+
+	return g
+}
+
+// ApplySort orders by the comma separated columns of spec, a "-" prefix sorts the
+// column descending, e.g. "-created_at,name". a column out of allowed fails the chain
+func (g *sql) ApplySort(spec string, allowed []string) abstraction.Sql {
+	var orders []clause.OrderByColumn
+
+	for _, item := range strings.Split(spec, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+
+		desc := strings.HasPrefix(item, "-")
+		column := strings.TrimLeft(item, "-+")
+
+		if !contains(allowed, column) {
+			return g.fail(fmt.Errorf("%w: %s", ErrSortColumn, column))
+		}
+
+		orders = append(orders, clause.OrderByColumn{Column: clause.Column{Name: column}, Desc: desc})
+	}
+
+	if len(orders) > 0 {
+		g.db = g.db.Clauses(clause.OrderBy{Columns: orders})
+	}
+
+	return g
+}
+
 func (g *sql) Or(query interface{}, args ...interface{}) abstraction.Sql {
 	g.db = g.db.Or(query, args...)
 	return g
@@ -192,7 +644,28 @@ func (g *sql) Limit(value int) abstraction.Sql {
 	return g
 }
 
+// LimitWithTies limits the result to n rows plus the rows tied with the last one
+// (FETCH FIRST n ROWS WITH TIES), it requires an Order. it fails the chain by
+// ErrLimitWithTies on the other dialects than postgres
+func (g *sql) LimitWithTies(n int) abstraction.Sql {
+	if g.Dialect() != "postgres" {
+		return g.fail(ErrLimitWithTies)
+	}
+
+	g.db = g.db.Clauses(limitWithTies{Limit: n})
+	return g
+}
+
 func (g *sql) Offset(value int) abstraction.Sql {
+	// a clause.Limit merged into a LimitWithTies would drop its tie limit
+	if c, ok := g.db.Statement.Clauses["LIMIT"]; ok {
+		if ties, ok := c.Expression.(limitWithTies); ok {
+			ties.Offset = value
+			g.db = g.db.Clauses(ties)
+			return g
+		}
+	}
+
 	g.db = g.db.Offset(value)
 	return g
 }
@@ -207,16 +680,130 @@ func (g *sql) Select(query interface{}, args ...interface{}) abstraction.Sql {
 	return g
 }
 
+// SelectCase adds "CASE WHEN ... THEN ... ELSE ... END AS alias" to the selected
+// columns, the args are bound to the placeholders of the cases and elseVal in order.
+// an empty elseVal omits the ELSE branch
+func (g *sql) SelectCase(cases []Case, elseVal, alias string, args ...interface{}) abstraction.Sql {
+	var expr strings.Builder
+	expr.WriteString("CASE")
+
+	for _, c := range cases {
+		expr.WriteString(" WHEN " + c.When + " THEN " + c.Then)
+	}
+
+	if elseVal != "" {
+		expr.WriteString(" ELSE " + elseVal)
+	}
+
+	expr.WriteString(" END AS " + g.quoteIdentifier(alias))
+
+	g.appendSelect(expr.String(), args...)
+	return g
+}
+
+// With prepends "WITH name AS (subquery)" to the query, the later calls append to
+// the WITH list. subquery must be built on another instance than g, e.g. by Session,
+// as the chain methods modify the instance they are called on
+func (g *sql) With(name string, subquery abstraction.Sql) abstraction.Sql {
+	if sub, ok := subquery.(*sql); ok {
+		g.db = g.db.Clauses(with{CTEs: []cte{{Name: name, Query: sub.db}}})
+	}
+
+	return g
+}
+
+// WithRecursive prepends "WITH RECURSIVE name AS (anchorSQL UNION ALL recursiveSQL)"
+// to the query, the args are bound to the placeholders of anchorSQL and recursiveSQL in order.
+// e.g. ("tree", "SELECT id, parent_id FROM categories WHERE id = ?",
+// "SELECT c.id, c.parent_id FROM categories c JOIN tree t ON c.parent_id = t.id", rootID)
+func (g *sql) WithRecursive(name, anchorSQL, recursiveSQL string, args ...interface{}) abstraction.Sql {
+	query := clause.Expr{SQL: fmt.Sprintf("%s UNION ALL %s", anchorSQL, recursiveSQL), Vars: args}
+
+	g.db = g.db.Clauses(with{Recursive: true, CTEs: []cte{{Name: name, Query: query}}})
+	return g
+}
+
+// OnConflictUpdateExpr makes the insert "ON CONFLICT (columns) DO UPDATE SET" the
+// assignments, a column to a raw sql expression, e.g. {"count": "counters.count + excluded.count"}
+func (g *sql) OnConflictUpdateExpr(columns []string, assignments map[string]string) abstraction.Sql {
+	names := make([]string, 0, len(assignments))
+	for name := range assignments {
+		names = append(names, name)
+	}
+
+	// a stable statement for the same assignments
+	sort.Strings(names)
+
+	onConflict := clause.OnConflict{DoUpdates: make(clause.Set, 0, len(names))}
+	for _, column := range columns {
+		onConflict.Columns = append(onConflict.Columns, clause.Column{Name: column})
+	}
+
+	for _, name := range names {
+		onConflict.DoUpdates = append(onConflict.DoUpdates, clause.Assignment{
+			Column: clause.Column{Name: name},
+			Value:  clause.Expr{SQL: assignments[name]},
+		})
+	}
+
+	g.db = g.db.Clauses(onConflict)
+	return g
+}
+
 func (g *sql) Omit(columns ...string) abstraction.Sql {
 	g.db = g.db.Omit(columns...)
 	return g
 }
 
+// WithDefaults leaves the columns out of the insert, so their database
+// DEFAULT applies instead of the Go zero value; it adds to the Omit columns
+func (g *sql) WithDefaults(columns ...string) abstraction.Sql {
+	g.db = g.db.Omit(append(append([]string{}, g.db.Statement.Omits...), columns...)...)
+	return g
+}
+
 func (g *sql) Group(query string) abstraction.Sql {
 	g.db = g.db.Group(query)
 	return g
 }
 
+// GroupRollup groups by ROLLUP (columns...), the subtotals of each level of the
+// columns in order and the grand total
+func (g *sql) GroupRollup(columns ...string) abstraction.Sql {
+	return g.Group(fmt.Sprintf("ROLLUP (%s)", g.quoteIdentifiers(columns)))
+}
+
+// GroupCube groups by CUBE (columns...), the subtotals of all the combinations
+// of the columns
+func (g *sql) GroupCube(columns ...string) abstraction.Sql {
+	return g.Group(fmt.Sprintf("CUBE (%s)", g.quoteIdentifiers(columns)))
+}
+
+// GroupingSets groups by GROUPING SETS, a set per grouping level and an empty
+// set for the grand total. e.g. {{"region", "city"}, {"region"}, {}}
+func (g *sql) GroupingSets(sets [][]string) abstraction.Sql {
+	groups := make([]string, 0, len(sets))
+	for _, set := range sets {
+		groups = append(groups, fmt.Sprintf("(%s)", g.quoteIdentifiers(set)))
+	}
+
+	return g.Group(fmt.Sprintf("GROUPING SETS (%s)", strings.Join(groups, ", ")))
+}
+
+// TimeBucket adds "date_trunc('interval', column) AS alias" to the selected columns
+// and groups by it; interval is a date_trunc field, e.g. hour, day or month
+func (g *sql) TimeBucket(column, interval, alias string) abstraction.Sql {
+	if !timeBucketIntervals[interval] {
+		return g.fail(fmt.Errorf("%w: %s", ErrInvalidInterval, interval))
+	}
+
+	bucket := fmt.Sprintf("date_trunc('%s', %s) AS %s", interval, g.quoteIdentifier(column), g.quoteIdentifier(alias))
+
+	g.appendSelect(bucket)
+	g.db = g.db.Group(alias)
+	return g
+}
+
 func (g *sql) Having(query string, values ...interface{}) abstraction.Sql {
 	g.db = g.db.Having(query, values...)
 	return g
@@ -227,25 +814,68 @@ func (g *sql) Joins(query string, args ...interface{}) abstraction.Sql {
 	return g
 }
 
+// Scopes applies the reusable query fragments on the query, a scope builds on the
+// Query passed to it through FromQuery, e.g.
+// func(q abstraction.Query) abstraction.Sql { return FromQuery(q).Where("active = ?", true) }
 func (g *sql) Scopes(funcs ...func(abstraction.Query) abstraction.Sql) abstraction.Sql {
-	var scopes []func(*gorm.DB) *gorm.DB
+	scopes := make([]func(*gorm.DB) *gorm.DB, 0, len(funcs))
 
-	/*for _, f := range funcs {
-		// Dereference the pointer to *gorm.DB and convert it to *gorm.DB
+	for _, f := range funcs {
+		f := f
 		scopes = append(scopes, func(db *gorm.DB) *gorm.DB {
-			return f(db) // in fact: f(abstraction.Query(db))
+			if scoped, ok := f(abstraction.Query(db)).(*sql); ok {
+				return scoped.db
+			}
+
+			return db
 		})
-	}*/
+	}
 
 	g.db = g.db.Scopes(scopes...)
 	return g
 }
 
+// FromQuery wraps the Query of a scope, so the scope adds its conditions by the wrapper methods
+func FromQuery(q abstraction.Query) abstraction.Sql {
+	return &sql{db: q}
+}
+
+// Unscoped applies to the current chain only, it is dropped as soon as
+// the chain is finished (First, Find, Delete, etc.)
 func (g *sql) Unscoped() abstraction.Sql {
 	g.db = g.db.Unscoped()
 	return g
 }
 
+// SkipHooks disables the model hooks(BeforeSave, AfterCreate, etc.) for the
+// current chain only, e.g. for the bulk backfills
+func (g *sql) SkipHooks() abstraction.Sql {
+	g.db = g.db.Session(&gorm.Session{SkipHooks: true})
+	return g
+}
+
+// PreserveTimestamps keeps the timestamps set on the models for the current chain
+// only, e.g. for the imports of historical data; the update doesn't set updated_at
+// and the insert of Save keeps the provided one. the zero timestamps of a create
+// are still set, as the updated_at of the conflict branch of an upsert
+func (g *sql) PreserveTimestamps() abstraction.Sql {
+	g.db = g.db.Set(preserveTimestampsKey, true)
+	return g
+}
+
+// SimpleProtocol runs the statements of the current chain only by the simple query
+// protocol, without the prepared statements, e.g. for the postgres_fdw tables whose
+// cached plans misbehave. it's a no-op on the other dialects than postgres
+func (g *sql) SimpleProtocol() abstraction.Sql {
+	if g.Dialect() != "postgres" {
+		return g
+	}
+
+	g.db = g.db.Session(&gorm.Session{Context: g.db.Statement.Context}) // a statement of its own
+	g.db.Statement.ConnPool = simpleProtocolPool{ConnPool: g.db.Statement.ConnPool}
+	return g
+}
+
 func (g *sql) Attrs(attrs ...interface{}) abstraction.Sql {
 	g.db = g.db.Attrs(attrs...)
 	return g
@@ -257,90 +887,256 @@ func (g *sql) Assign(attrs ...interface{}) abstraction.Sql {
 }
 
 func (g *sql) First(out interface{}, where ...interface{}) abstraction.Sql {
-	g.db = g.db.First(out, where...)
-	return g
+	return g.finish(g.db.First(out, where...))
+}
+
+// FirstOrNil works as First but a missing record isn't an error, it's reported
+// by found as false
+func (g *sql) FirstOrNil(out interface{}, where ...interface{}) (found bool, err error) {
+	db := g.db.First(out, where...)
+	g.finish(db)
+
+	if errors.Is(db.Error, gorm.ErrRecordNotFound) {
+		db.Error = nil
+		return false, nil
+	}
+
+	return db.Error == nil, db.Error
 }
 
 func (g *sql) Last(out interface{}, where ...interface{}) abstraction.Sql {
-	g.db = g.db.Last(out, where...)
-	return g
+	return g.finish(g.db.Last(out, where...))
 }
 
 func (g *sql) Find(out interface{}, where ...interface{}) abstraction.Sql {
-	g.db = g.db.Find(out, where...)
-	return g
+	return g.finish(g.db.Find(out, where...))
 }
 
+// Scan scans the result into dest, which must be a pointer to a struct, a map,
+// a slice of them or, for the single-column queries only, to a primitive or a
+// slice of primitives (e.g. *[]int64, *[]string)
 func (g *sql) Scan(dest interface{}) abstraction.Sql {
-	g.db = g.db.Scan(dest)
-	return g
+	db := g.db.Set(scanKey, true).Scan(dest)
+	if g.config.MaxResultRows > 0 {
+		g.checkResultRows(db)
+	}
+
+	return g.finish(db)
 }
 
 func (g *sql) Row() *SdkSql.Row {
-	return g.db.Row()
+	g.db = g.db.Scopes() // a no-op, for the statement to run on the chain instance
+	row := g.db.Row()
+	g.finish(g.db)
+	return row
 }
 
 func (g *sql) Rows() (*SdkSql.Rows, error) {
-	return g.db.Rows()
+	g.db = g.db.Scopes() // a no-op, for the statement to run on the chain instance
+	rows, err := g.db.Rows()
+	g.finish(g.db)
+	return rows, err
 }
 
 func (g *sql) ScanRows(rows *SdkSql.Rows, result interface{}) error {
 	return g.db.ScanRows(rows, result)
 }
 
+// Columns runs the query and returns the metadata of the result columns
+func (g *sql) Columns() ([]ColumnInfo, error) {
+	rows, err := g.Rows()
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	types, err := rows.ColumnTypes()
+	if err != nil {
+		return nil, err
+	}
+
+	columns := make([]ColumnInfo, 0, len(types))
+	for _, columnType := range types {
+		nullable, ok := columnType.Nullable()
+		columns = append(columns, ColumnInfo{
+			Name:          columnType.Name(),
+			DatabaseType:  columnType.DatabaseTypeName(),
+			Nullable:      nullable,
+			NullableKnown: ok,
+		})
+	}
+
+	return columns, nil
+}
+
+// WhichExist returns the subset of values present in the column of the model
+// table, in one query; the items are typed as returned by the driver
+func (g *sql) WhichExist(model interface{}, column string, values []interface{}) ([]interface{}, error) {
+	if len(values) == 0 {
+		return nil, nil
+	}
+
+	var existing []interface{}
+	err := g.session().
+		Set(uncappedKey, true).
+		Model(model).
+		Where(clause.IN{Column: clause.Column{Name: column}, Values: values}).
+		Distinct(column).
+		Pluck(column, &existing).
+		Error
+
+	return existing, err
+}
+
 func (g *sql) Pluck(column string, value interface{}) abstraction.Sql {
-	g.db = g.db.Pluck(column, value)
-	return g
+	return g.finish(g.db.Pluck(column, value))
 }
 
 func (g *sql) Count(value *int64) abstraction.Sql {
-	g.db = g.db.Count(value)
-	return g
+	return g.finish(g.db.Count(value))
+}
+
+// CountWhere returns the count of the model rows matching the condition
+func (g *sql) CountWhere(model interface{}, query interface{}, args ...interface{}) (int64, error) {
+	var count int64
+	err := g.session().Model(model).Where(query, args...).Count(&count).Error
+
+	return count, err
 }
 
 func (g *sql) FirstOrInit(out interface{}, where ...interface{}) abstraction.Sql {
-	g.db = g.db.FirstOrInit(out, where...)
-	return g
+	return g.finish(g.db.FirstOrInit(out, where...))
 }
 
 func (g *sql) FirstOrCreate(out interface{}, where ...interface{}) abstraction.Sql {
-	g.db = g.db.FirstOrCreate(out, where...)
-	return g
+	return g.finish(g.db.FirstOrCreate(out, where...))
+}
+
+// FirstOrCreateWithFlag works as FirstOrCreate and reports whether the
+// record has been created or an existing one has been found
+func (g *sql) FirstOrCreateWithFlag(out interface{}, where ...interface{}) (created bool, err error) {
+	// the insert clause is the creation mark, drop the leftover of a previous Create on the chain
+	if _, ok := g.db.Statement.Clauses["INSERT"]; ok {
+		delete(g.db.Statement.Clauses, "INSERT")
+	}
+
+	db := g.db.FirstOrCreate(out, where...)
+	g.finish(db)
+
+	if db.Error != nil {
+		return false, db.Error
+	}
+
+	_, inserted := db.Statement.Clauses["INSERT"]
+
+	return inserted && db.RowsAffected > 0, nil
 }
 
 func (g *sql) Update(column string, attrs ...interface{}) abstraction.Sql {
-	g.db = g.db.Update(column, attrs)
-	return g
+	return g.finish(g.db.Update(column, attrs))
 }
 
 func (g *sql) Updates(values interface{}) abstraction.Sql {
-	g.db = g.db.Updates(values)
-	return g
+	return g.finish(g.db.Updates(values))
+}
+
+// UpdateCapturing updates the rows of the chain conditions by values, as Updates, and
+// scans the updated rows (RETURNING *) into dest. the hooks of model don't run, the
+// auto update time columns are set still
+func (g *sql) UpdateCapturing(model interface{}, values interface{}, dest *[]map[string]interface{}) error {
+	err := g.updateCapturing(g.db, model, values, dest)
+	g.finish(g.db)
+
+	return err
+}
+
+// UpdateSnapshot works as UpdateCapturing and scans the rows into before prior to the
+// update, the rows are locked (SELECT ... FOR UPDATE) in a transaction until the update
+func (g *sql) UpdateSnapshot(model interface{}, values interface{}, before, after *[]map[string]interface{}) error {
+	err := g.transaction(g.db, func(tx *gorm.DB) error {
+		locked := tx.Session(&gorm.Session{}).Set(uncappedKey, true).Model(model).Clauses(clause.Locking{Strength: "UPDATE"}).Find(before)
+		if locked.Error != nil {
+			return locked.Error
+		}
+
+		return g.updateCapturing(tx, model, values, after)
+	})
+	g.finish(g.db)
+
+	return err
 }
 
 func (g *sql) UpdateColumn(column string, attrs ...interface{}) abstraction.Sql {
-	g.db = g.db.UpdateColumn(column, attrs)
-	return g
+	return g.finish(g.db.UpdateColumn(column, attrs))
 }
 
 func (g *sql) UpdateColumns(values interface{}) abstraction.Sql {
-	g.db = g.db.UpdateColumns(values)
-	return g
+	return g.finish(g.db.UpdateColumns(values))
 }
 
 func (g *sql) Save(value interface{}) abstraction.Sql {
-	g.db = g.db.Save(value)
-	return g
+	return g.finish(g.db.Save(value))
 }
 
 func (g *sql) Create(value interface{}) abstraction.Sql {
-	g.db = g.db.Create(value)
-	return g
+	return g.finish(g.db.Create(value))
 }
 
-func (g *sql) Delete(value interface{}, where ...interface{}) abstraction.Sql {
-	g.db = g.db.Delete(value, where...)
-	return g
+// CreateInBatches inserts the value slice in batches of batchSize, the
+// generated primary keys of all the batches are returned (RETURNING) and set
+// back on the items of the slice
+func (g *sql) CreateInBatches(value interface{}, batchSize int) abstraction.Sql {
+	return g.finish(g.db.CreateInBatches(value, batchSize))
+}
+
+func (g *sql) Delete(value interface{}, where ...interface{}) abstraction.Sql {
+	return g.finish(g.db.Delete(value, where...))
+}
+
+// PurgeTrashed hard deletes the soft deleted rows of the model table whose soft delete
+// column (of its gorm.DeletedAt field) is before olderThan, and returns the count of the
+// purged rows. it fails by ErrNotSoftDeleted if the model has no gorm.DeletedAt field
+func (g *sql) PurgeTrashed(model interface{}, olderThan time.Time) (int64, error) {
+	stmt := &gorm.Statement{DB: g.db}
+	if err := stmt.Parse(model); err != nil {
+		return 0, err
+	}
+
+	var column string
+	for _, field := range stmt.Schema.Fields {
+		if field.FieldType == reflect.TypeOf(gorm.DeletedAt{}) {
+			column = field.DBName
+			break
+		}
+	}
+
+	if column == "" {
+		return 0, fmt.Errorf("%w: %s", ErrNotSoftDeleted, stmt.Schema.Name)
+	}
+
+	result := g.session().
+		Unscoped().
+		Where(clause.Lt{Column: clause.Column{Table: clause.CurrentTable, Name: column}, Value: olderThan}).
+		Delete(model)
+
+	return result.RowsAffected, result.Error
+}
+
+// Truncate empties the tables, restartIdentity restarts their identity and serial sequences
+func (g *sql) Truncate(restartIdentity bool, tables ...string) error {
+	query := fmt.Sprintf("TRUNCATE TABLE %s", g.quoteIdentifiers(tables))
+	if restartIdentity {
+		query = fmt.Sprintf("%s RESTART IDENTITY", query)
+	}
+
+	return g.exec(query)
+}
+
+// ResetSequence restarts the sequence of the serial or identity column, the
+// next inserted row gets 1
+func (g *sql) ResetSequence(table, column string) error {
+	return g.exec("SELECT setval(pg_get_serial_sequence(?, ?), 1, false)", table, column)
 }
 
 func (g *sql) Raw(sql string, values ...interface{}) abstraction.Sql {
@@ -349,8 +1145,7 @@ func (g *sql) Raw(sql string, values ...interface{}) abstraction.Sql {
 }
 
 func (g *sql) Exec(sql string, values ...interface{}) abstraction.Sql {
-	g.db = g.db.Exec(sql, values...)
-	return g
+	return g.finish(g.db.Exec(sql, values...))
 }
 
 func (g *sql) Model(value interface{}) abstraction.Sql {
@@ -358,44 +1153,396 @@ func (g *sql) Model(value interface{}) abstraction.Sql {
 	return g
 }
 
+// Table overrides the table of the current chain, a schema qualified name
+// (e.g. "other_schema.reporting_view") is quoted per part and used as is
 func (g *sql) Table(name string) abstraction.Sql {
 	g.db = g.db.Table(name)
 	return g
 }
 
+// Partition targets the partition of a partitioned table, e.g. "events_2024_01", the
+// model schema still applies. the writes to the parent table are routed by postgres,
+// Partition skips the routing; an ON CONFLICT target must include the partition key
+func (g *sql) Partition(name string) abstraction.Sql {
+	return g.Table(name)
+}
+
+// Upsert inserts value or updates all its columns on a conflict of conflictColumns,
+// the primary keys by default. the unique constraints of a partitioned table include
+// its partition key, so must the conflict target, e.g. Upsert(&event, "id", "created_at")
+func (g *sql) Upsert(value interface{}, conflictColumns ...string) abstraction.Sql {
+	onConflict := clause.OnConflict{UpdateAll: true}
+	for _, column := range conflictColumns {
+		onConflict.Columns = append(onConflict.Columns, clause.Column{Name: column})
+	}
+
+	return g.finish(g.db.Clauses(onConflict).Create(value))
+}
+
+// ToSQL renders the sql built by query, with its args interpolated, without executing it
+func (g *sql) ToSQL(query func(q abstraction.Sql) abstraction.Sql) string {
+	return g.session().ToSQL(func(tx *gorm.DB) *gorm.DB {
+		if q, ok := query(g.clone(tx)).(*sql); ok {
+			return q.db
+		}
+
+		return tx
+	})
+}
+
 func (g *sql) Debug() abstraction.Sql {
 	g.db = g.db.Debug()
 	return g
 }
 
+// Session returns a dedicated instance with a fresh statement, on the connection (or
+// transaction) of g, so a request builds its chain without sharing the state of g
+func (g *sql) Session() abstraction.Sql {
+	return g.clone(g.session())
+}
+
+// WithContext returns a dedicated instance with a fresh statement, as Session, whose
+// statements run with ctx, e.g. for the cancellation and the timeout of a request
+func (g *sql) WithContext(ctx context.Context) abstraction.Sql {
+	return g.clone(g.session().Session(&gorm.Session{NewDB: true, Context: ctx}))
+}
+
+// Begin returns a dedicated instance with a fresh statement bound to a new
+// transaction, Commit and Rollback are called on it; g isn't bound to the transaction
 func (g *sql) Begin() abstraction.Sql {
-	g.db = g.db.Begin()
-	return g
+	tx := g.session().Begin()
+	if pool, ok := transactionOf(tx.Statement.ConnPool); ok && tx.Error == nil && g.audits != nil {
+		g.audits.open(pool)
+	}
+
+	return g.clone(tx)
 }
 
+// Commit commits the transaction of a Begin instance, it fails the chain by
+// gorm.ErrInvalidTransaction on an instance out of a transaction
 func (g *sql) Commit() abstraction.Sql {
-	g.db = g.db.Commit()
+	tx, ok := transactionOf(g.db.Statement.ConnPool)
+	if !ok {
+		return g.fail(gorm.ErrInvalidTransaction)
+	}
+
+	// the chain may carry an earlier error, the events depend on the commit only
+	err := tx.(gorm.TxCommitter).Commit()
+	_ = g.db.AddError(err)
+	g.settleAudit(tx, err == nil)
+	g.leaveTransaction()
 	return g
 }
 
+// Rollback rolls the transaction of a Begin instance back, it fails the chain by
+// gorm.ErrInvalidTransaction on an instance out of a transaction
 func (g *sql) Rollback() abstraction.Sql {
+	tx, ok := transactionOf(g.db.Statement.ConnPool)
+	if !ok {
+		return g.fail(gorm.ErrInvalidTransaction)
+	}
+
 	g.db = g.db.Rollback()
+	g.settleAudit(tx, false)
+	g.leaveTransaction()
+	return g
+}
+
+// InTransaction reports whether the instance is bound to a transaction
+func (g *sql) InTransaction() bool {
+	_, ok := transactionOf(g.db.Statement.ConnPool)
+	return ok
+}
+
+// Dialect returns the name of the active dialector, e.g. postgres, mysql or sqlite
+func (g *sql) Dialect() string {
+	return g.db.Dialector.Name()
+}
+
+// Transaction runs fc in a transaction, the tx passed to fc is a dedicated
+// instance bound to the transaction and doesn't share the state of g
+func (g *sql) Transaction(fc func(tx abstraction.Sql) error, opts ...*SdkSql.TxOptions) error {
+	return g.transaction(g.session(), func(tx *gorm.DB) error {
+		return fc(g.clone(tx))
+	}, opts...)
+}
+
+// transaction runs fc in a transaction of db, every transaction of the wrapper runs
+// by it, so the audit events of its writes are held until the outermost commit
+func (g *sql) transaction(db *gorm.DB, fc func(tx *gorm.DB) error, opts ...*SdkSql.TxOptions) error {
+	var (
+		_, nested = transactionOf(db.Statement.ConnPool) // runs in a savepoint of the outer transaction
+		pool      gorm.ConnPool
+		mark      int
+	)
+
+	err := db.Transaction(func(tx *gorm.DB) error {
+		pool, _ = transactionOf(tx.Statement.ConnPool)
+		switch {
+		case g.audits == nil:
+		case nested:
+			mark = g.audits.mark(pool)
+		default:
+			g.audits.open(pool)
+		}
+
+		return fc(tx)
+	}, opts...)
+
+	switch {
+	case nested && err != nil && g.audits != nil:
+		g.audits.truncate(pool, mark)
+	case !nested:
+		g.settleAudit(pool, err == nil)
+	}
+
+	return err
+}
+
+// WithOutbox runs fc and inserts the events into the OutboxTable in the same
+// transaction, so the events are stored only if the changes of fc are committed
+func (g *sql) WithOutbox(fc func(tx abstraction.Sql) error, events ...OutboxEvent) error {
+	if g.config.OutboxTable == "" {
+		return ErrOutboxNotConfigured
+	}
+
+	rows := make([]map[string]interface{}, 0, len(events))
+	for _, event := range events {
+		payload, err := json.Marshal(event.Payload)
+		if err != nil {
+			return err
+		}
+
+		rows = append(rows, map[string]interface{}{
+			"topic":      event.Topic,
+			"key":        event.Key,
+			"payload":    string(payload),
+			"created_at": g.db.NowFunc(),
+		})
+	}
+
+	return g.Transaction(func(tx abstraction.Sql) error {
+		if err := fc(tx); err != nil {
+			return err
+		}
+
+		if len(rows) == 0 {
+			return nil
+		}
+
+		// a fresh statement, fc may leave a model or conditions on tx
+		return tx.(*sql).session().Table(g.config.OutboxTable).Create(&rows).Error
+	})
+}
+
+// DeferConstraints postpones the constraint checks of the current transaction
+// to the commit, only the constraints declared as DEFERRABLE are affected. postgres
+// ignores it out of a transaction, so it fails there by gorm.ErrInvalidTransaction
+func (g *sql) DeferConstraints() abstraction.Sql {
+	if !g.InTransaction() {
+		return g.fail(gorm.ErrInvalidTransaction)
+	}
+
+	return g.Exec("SET CONSTRAINTS ALL DEFERRED")
+}
+
+// SuggestIndexes explains the SELECT queries slower than threshold, once per query,
+// and logs the sequential scans filtering the large tables, whose filtered columns
+// likely miss an index. it's called once, it's a no-op on the other dialects than postgres
+func (g *sql) SuggestIndexes(threshold time.Duration) {
+	if g.Dialect() != "postgres" {
+		return
+	}
+
+	pool, log := g.db.ConnPool, g.db.Logger
+	g.watchSlowQueries(slowQueries{
+		threshold: threshold,
+		onSlow: func(query string, vars []interface{}) {
+			explainSlowQuery(pool, log, query, vars)
+		},
+		seen: newSeenQueries(slowQueriesLimit),
+	})
+}
+
+// watchSlowQueries registers the callbacks of slow around the queries and the rows
+// (Scan, Row, Rows) statements
+func (g *sql) watchSlowQueries(slow slowQueries) {
+	callbacks := g.db.Callback()
+	errs := []error{
+		callbacks.Query().Before("gorm:query").Register("sqlwrapper:slow_query_start", slow.start),
+		callbacks.Query().After("gorm:query").Register("sqlwrapper:slow_query", slow.check),
+		callbacks.Row().Before("gorm:row").Register("sqlwrapper:slow_query_start", slow.start),
+		callbacks.Row().After("gorm:row").Register("sqlwrapper:slow_query", slow.check),
+	}
+
+	for _, err := range errs {
+		if err != nil {
+			helper.CustomPanic(g.locale.Get("sql_register_callback_err"), err)
+		}
+	}
+}
+
+// Analyze refreshes the planner statistics of the tables, all the tables of the
+// database if none is passed
+func (g *sql) Analyze(tables ...string) error {
+	return g.maintain("ANALYZE", tables)
+}
+
+// VacuumAnalyze reclaims the storage of the tables and refreshes their statistics,
+// all the tables of the database if none is passed
+func (g *sql) VacuumAnalyze(tables ...string) error {
+	return g.maintain("VACUUM (ANALYZE)", tables)
+}
+
+// CreatePartialIndex creates the unique index on the columns(comma separated) of
+// the table, only for the rows matching whereClause, if it doesn't exist.
+// e.g. ("users", "users_email_unique", "email", "deleted_at IS NULL")
+func (g *sql) CreatePartialIndex(table, name, columns, whereClause string) error {
+	query := fmt.Sprintf(
+		"CREATE UNIQUE INDEX IF NOT EXISTS %s ON %s (%s)",
+		g.quoteIdentifier(name),
+		g.quoteIdentifier(table),
+		g.quoteIdentifiers(strings.Split(columns, ",")),
+	)
+	if whereClause != "" {
+		query = fmt.Sprintf("%s WHERE %s", query, whereClause)
+	}
+
+	return g.exec(query)
+}
+
+// CreateEnum creates the enum type of the values if it doesn't exist, it runs
+// before AutoMigrate so the columns of the type (e.g. `gorm:"type:mood"`) are created
+func (g *sql) CreateEnum(name string, values []string) error {
+	if !g.config.DryRun {
+		var exists bool
+		if err := g.session().Raw("SELECT to_regtype(?) IS NOT NULL", g.quoteIdentifier(name)).Scan(&exists).Error; err != nil {
+			return err
+		}
+
+		if exists {
+			return nil
+		}
+	}
+
+	labels := make([]string, 0, len(values))
+	for _, value := range values {
+		labels = append(labels, quoteLiteral(value))
+	}
+
+	return g.exec(fmt.Sprintf("CREATE TYPE %s AS ENUM (%s)", g.quoteIdentifier(name), strings.Join(labels, ", ")))
+}
+
+// AddEnumValue appends the value to the labels of the enum type if it isn't one of them
+func (g *sql) AddEnumValue(name, value string) error {
+	return g.exec(fmt.Sprintf("ALTER TYPE %s ADD VALUE IF NOT EXISTS %s", g.quoteIdentifier(name), quoteLiteral(value)))
+}
+
+// Lock locks the selected rows (SELECT ... FOR strength) until the end of the
+// transaction, strength is one of the Lock constants and option is NOWAIT, SKIP LOCKED or empty
+func (g *sql) Lock(strength, option string) abstraction.Sql {
+	switch strength {
+	case LockUpdate, LockNoKeyUpdate, LockShare, LockKeyShare:
+	default:
+		return g.fail(fmt.Errorf("%w: %s", ErrLockStrength, strength))
+	}
+
+	switch option {
+	case "", "NOWAIT", "SKIP LOCKED":
+	default:
+		return g.fail(fmt.Errorf("%w: %s", ErrLockOption, option))
+	}
+
+	g.db = g.db.Clauses(clause.Locking{Strength: strength, Options: option})
 	return g
 }
 
+// WithLockTimeout makes the statements of the current transaction fail if a lock
+// isn't acquired within d, instead of waiting for the long-running transactions.
+// d is rounded up to the milliseconds, a non-positive d fails by ErrLockTimeout
+// as postgres takes a zero lock_timeout for no timeout. postgres ignores the setting
+// out of a transaction, so it fails there by gorm.ErrInvalidTransaction
+func (g *sql) WithLockTimeout(d time.Duration) abstraction.Sql {
+	if !g.InTransaction() {
+		return g.fail(gorm.ErrInvalidTransaction)
+	}
+
+	if d <= 0 {
+		return g.fail(ErrLockTimeout)
+	}
+
+	ms := (d + time.Millisecond - 1) / time.Millisecond
+	return g.Exec(fmt.Sprintf("SET LOCAL lock_timeout = %d", ms))
+}
+
+// Prepared runs query on a dedicated instance with a fresh statement, which
+// prepares its sql once and reuses the prepared statement on the next calls,
+// e.g. the same lookup with different args in a loop
+func (g *sql) Prepared(query func(q abstraction.Sql) abstraction.Sql) abstraction.Sql {
+	return query(g.clone(g.db.Session(&gorm.Session{NewDB: true, PrepareStmt: true})))
+}
+
+// ReplicaLag returns the replay lag of the connected replica, zero on a primary
+// or on a replica which has replayed all the received changes
+func (g *sql) ReplicaLag() (time.Duration, error) {
+	var seconds float64
+	err := g.session().Raw(`SELECT CASE
+		WHEN pg_last_wal_receive_lsn() = pg_last_wal_replay_lsn() THEN 0
+		ELSE COALESCE(EXTRACT(EPOCH FROM now() - pg_last_xact_replay_timestamp()), 0)
+	END`).Row().Scan(&seconds)
+	if err != nil {
+		return 0, err
+	}
+
+	return time.Duration(seconds * float64(time.Second)), nil
+}
+
 func (g *sql) AutoMigrate(values ...interface{}) error {
 	return g.db.AutoMigrate(values...)
 }
 
+// AutoMigrateInSchema migrates the models into the schema, created if it doesn't
+// exist. the migration runs in a transaction whose search_path is the schema
+func (g *sql) AutoMigrateInSchema(schema string, values ...interface{}) error {
+	quoted := g.quoteIdentifier(schema)
+
+	return g.transaction(g.session(), func(tx *gorm.DB) error {
+		if err := tx.Exec(fmt.Sprintf("CREATE SCHEMA IF NOT EXISTS %s", quoted)).Error; err != nil {
+			return err
+		}
+
+		if err := tx.Exec(fmt.Sprintf("SET LOCAL search_path TO %s", quoted)).Error; err != nil {
+			return err
+		}
+
+		return tx.AutoMigrate(values...)
+	})
+}
+
 func (g *sql) Association(column string) *gorm.Association {
 	return g.db.Association(column)
 }
 
+// ReplaceAssociation replaces the association of model by values in a transaction,
+// the records out of values are unlinked only if the new ones are saved
+func (g *sql) ReplaceAssociation(model interface{}, column string, values interface{}) error {
+	return g.transaction(g.session(), func(tx *gorm.DB) error {
+		return tx.Model(model).Association(column).Replace(values)
+	})
+}
+
 func (g *sql) Preload(column string, conditions ...interface{}) abstraction.Sql {
 	g.db = g.db.Preload(column, conditions...)
 	return g
 }
 
+// JoinPreload eager loads the has-one/belongs-to association in the same query,
+// by a LEFT JOIN, instead of the extra query of Preload
+func (g *sql) JoinPreload(assoc string, conditions ...interface{}) abstraction.Sql {
+	g.db = g.db.Joins(assoc, conditions...)
+	return g
+}
+
 func (g *sql) Set(name string, value interface{}) abstraction.Sql {
 	g.db = g.db.Set(name, value)
 	return g
@@ -419,6 +1566,47 @@ func (g *sql) SetJoinTable(model interface{}, column string, handler interface{}
 	return nil
 }
 
+// SetJoinTableOnDelete works as SetJoinTable and sets the ON DELETE action(e.g. CASCADE)
+// of the join table foreign keys, created by the next AutoMigrate, so the join rows
+// are removed along with either side of the many-to-many relation
+func (g *sql) SetJoinTableOnDelete(model interface{}, column string, handler interface{}, onDelete string) error {
+	err := g.SetJoinTable(model, column, handler)
+	if err != nil {
+		return err
+	}
+
+	stmt := &gorm.Statement{DB: g.db}
+	if err = stmt.Parse(model); err != nil {
+		return err
+	}
+
+	relation := stmt.Schema.Relationships.Relations[column]
+
+	for _, joinRelation := range relation.JoinTable.Relationships.Relations {
+		if joinRelation.Field == nil || joinRelation.Field != relation.Field {
+			continue
+		}
+
+		// the join foreign keys take the constraint of the many-to-many field,
+		// a copy of the field keeps the tag of the relation itself untouched
+		field := *joinRelation.Field
+		field.TagSettings = make(map[string]string, len(relation.Field.TagSettings))
+		for key, value := range relation.Field.TagSettings {
+			field.TagSettings[key] = value
+		}
+
+		constraint := "OnDelete:" + onDelete
+		if onUpdate := schema.ParseTagSetting(field.TagSettings["CONSTRAINT"], ",")["ONUPDATE"]; onUpdate != "" {
+			constraint = fmt.Sprintf("%s,OnUpdate:%s", constraint, onUpdate)
+		}
+
+		field.TagSettings["CONSTRAINT"] = constraint
+		joinRelation.Field = &field
+	}
+
+	return nil
+}
+
 func (g *sql) AddError(err error) error {
 	return g.db.AddError(err)
 }
@@ -431,6 +1619,15 @@ func (g *sql) Error() error {
 	return g.db.Error
 }
 
+// LastSQL returns the last statement executed by the instance and its args, the
+// statement is kept on the executed one, so the other instances don't overwrite it
+func (g *sql) LastSQL() (query string, args []interface{}) {
+	last, _ := g.db.InstanceGet(lastSqlKey)
+	executed, _ := last.(statement)
+
+	return executed.query, executed.args
+}
+
 // HELPER METHODS
 
 func (g *sql) newGormLog(SlowSqlThreshold int) logger.Interface {
@@ -444,6 +1641,718 @@ func (g *sql) newGormLog(SlowSqlThreshold int) logger.Interface {
 		})
 }
 
+func (g *sql) registerCallbacks(database *gorm.DB) {
+	callbacks := database.Callback()
+
+	captureLastSql := func(db *gorm.DB) {
+		db.InstanceSet(lastSqlKey, statement{
+			query: db.Statement.SQL.String(),
+			args:  append([]interface{}(nil), db.Statement.Vars...),
+		})
+	}
+
+	errs := []error{
+		callbacks.Create().After("gorm:create").Register("sqlwrapper:last_sql", captureLastSql),
+		callbacks.Query().After("gorm:query").Register("sqlwrapper:last_sql", captureLastSql),
+		callbacks.Update().After("gorm:update").Register("sqlwrapper:last_sql", captureLastSql),
+		callbacks.Delete().After("gorm:delete").Register("sqlwrapper:last_sql", captureLastSql),
+		callbacks.Row().After("gorm:row").Register("sqlwrapper:last_sql", captureLastSql),
+		callbacks.Raw().After("gorm:raw").Register("sqlwrapper:last_sql", captureLastSql),
+	}
+
+	errs = append(errs,
+		callbacks.Create().Before("gorm:create").Register("sqlwrapper:preserve_timestamps", keepUpdateTime),
+		callbacks.Update().After("gorm:save_before_associations").Before("gorm:update").
+			Register("sqlwrapper:preserve_timestamps", skipUpdateTime),
+		callbacks.Update().After("gorm:update").Before("gorm:save_after_associations").
+			Register("sqlwrapper:restore_hooks", restoreHooks),
+		callbacks.Update().After("gorm:save_before_associations").Before("gorm:update").
+			Register("sqlwrapper:track_update_time", trackUpdateTime),
+		callbacks.Update().After("gorm:update").Before("gorm:save_after_associations").
+			Register("sqlwrapper:skip_hooks", skipHooksBack),
+	)
+
+	if g.config.MaxResultRows > 0 {
+		errs = append(errs,
+			callbacks.Query().Before("gorm:query").Register("sqlwrapper:max_result_rows", g.capResultRows),
+			callbacks.Query().After("gorm:query").Before("gorm:preload").
+				Register("sqlwrapper:check_result_rows", g.checkResultRows),
+			// the rows of a Scan are counted by Scan once they're read
+			callbacks.Row().Before("gorm:row").Register("sqlwrapper:max_result_rows", g.capScannedRows),
+		)
+	}
+
+	if g.config.IsolationLevel != "" {
+		level, err := g.isolationLevel()
+		if err != nil {
+			helper.CustomPanic("", err)
+		}
+
+		begin := g.beginTransaction(level)
+		errs = append(errs,
+			callbacks.Create().Replace("gorm:begin_transaction", begin),
+			callbacks.Update().Replace("gorm:begin_transaction", begin),
+			callbacks.Delete().Replace("gorm:begin_transaction", begin),
+		)
+	}
+
+	if g.config.Metrics && g.rowsObserver != nil {
+		errs = append(errs, callbacks.Query().After("gorm:query").Register("sqlwrapper:rows_returned", g.observeRows))
+	}
+
+	// the audit runs after the default transaction of the write is committed
+	if g.auditSink != nil {
+		errs = append(errs,
+			callbacks.Create().After("gorm:commit_or_rollback_transaction").Register("sqlwrapper:audit", g.audit("create")),
+			callbacks.Update().After("gorm:commit_or_rollback_transaction").Register("sqlwrapper:audit", g.audit("update")),
+			callbacks.Delete().After("gorm:commit_or_rollback_transaction").Register("sqlwrapper:audit", g.audit("delete")),
+		)
+	}
+
+	for _, err := range errs {
+		if err != nil {
+			helper.CustomPanic(g.locale.Get("sql_register_callback_err"), err)
+		}
+	}
+}
+
+// beginTransaction works as the gorm default transaction callback, the transaction
+// begins at the isolation level
+func (g *sql) beginTransaction(level SdkSql.IsolationLevel) func(*gorm.DB) {
+	return func(db *gorm.DB) {
+		if db.Config.SkipDefaultTransaction || db.Error != nil {
+			return
+		}
+
+		if tx := db.Begin(&SdkSql.TxOptions{Isolation: level}); tx.Error == nil {
+			db.Statement.ConnPool = tx.Statement.ConnPool
+			db.InstanceSet("gorm:started_transaction", true)
+		} else if !errors.Is(tx.Error, gorm.ErrInvalidTransaction) {
+			db.Error = tx.Error
+		}
+	}
+}
+
+// isolationLevel maps the IsolationLevel config to the database/sql level, case-insensitive
+func (g *sql) isolationLevel() (SdkSql.IsolationLevel, error) {
+	for level := SdkSql.LevelDefault; level <= SdkSql.LevelLinearizable; level++ {
+		if strings.EqualFold(level.String(), strings.TrimSpace(g.config.IsolationLevel)) {
+			return level, nil
+		}
+	}
+
+	return SdkSql.LevelDefault, fmt.Errorf("%w: %s", ErrIsolationLevel, g.config.IsolationLevel)
+}
+
+// observeRows reports the rows returned by the query, the DryRun ones aren't executed
+func (g *sql) observeRows(db *gorm.DB) {
+	if db.Error != nil || db.DryRun {
+		return
+	}
+
+	g.rowsObserver(db.Statement.Table, db.RowsAffected)
+}
+
+// keepUpdateTime keeps the updated_at of the models inserted by Save on a
+// PreserveTimestamps chain, Save sets it to now
+func keepUpdateTime(db *gorm.DB) {
+	if preserve, _ := db.Get(preserveTimestampsKey); preserve == true {
+		db.Statement.Settings.Delete("gorm:update_track_time")
+	}
+}
+
+// skipUpdateTime skips the hooks for the gorm:update callback of a PreserveTimestamps
+// chain, gorm doesn't set the auto update time if the hooks are skipped
+func skipUpdateTime(db *gorm.DB) {
+	if preserve, _ := db.Get(preserveTimestampsKey); preserve != true || db.Statement.SkipHooks {
+		return
+	}
+
+	db.Statement.SkipHooks = true
+	db.InstanceSet(preserveTimestampsKey, true)
+}
+
+// restoreHooks enables the hooks skipped by skipUpdateTime back, for the after update hooks
+func restoreHooks(db *gorm.DB) {
+	if skipped, _ := db.InstanceGet(preserveTimestampsKey); skipped == true {
+		db.Statement.SkipHooks = false
+	}
+}
+
+// trackUpdateTime enables the hooks for the gorm:update callback of an UpdateCapturing
+// render, which skips the hooks of model, for gorm to set the auto update time
+func trackUpdateTime(db *gorm.DB) {
+	if capturing, _ := db.Get(capturingKey); capturing != true || !db.Statement.SkipHooks {
+		return
+	}
+
+	if preserve, _ := db.Get(preserveTimestampsKey); preserve == true {
+		return
+	}
+
+	db.Statement.SkipHooks = false
+	db.InstanceSet(capturingKey, true)
+}
+
+// skipHooksBack skips the hooks enabled by trackUpdateTime back, for the after update hooks
+func skipHooksBack(db *gorm.DB) {
+	if tracked, _ := db.InstanceGet(capturingKey); tracked == true {
+		db.Statement.SkipHooks = true
+	}
+}
+
+// capResultRows adds LIMIT MaxResultRows+1 to the query built by the chain if it has
+// no LIMIT, for checkResultRows to tell an exceeding result. the Raw queries, the Count,
+// the subqueries and the uncappedKey queries aren't capped and Limit(-1) opts out.
+// the subqueries are rendered by a DryRun session
+func (g *sql) capResultRows(db *gorm.DB) {
+	if db.Error != nil || db.Statement.SQL.Len() > 0 || (db.DryRun && !g.config.DryRun) {
+		return
+	}
+
+	if _, uncapped := db.Get(uncappedKey); uncapped {
+		return
+	}
+
+	if _, isCount := db.Statement.Dest.(*int64); isCount {
+		return
+	}
+
+	// the preloads of the query load the associations of the rows as a whole
+	db.Statement.Settings.Store(uncappedKey, true)
+
+	if c, ok := db.Statement.Clauses["LIMIT"]; ok {
+		if current, isLimit := c.Expression.(clause.Limit); !isLimit || current.Limit != nil {
+			return
+		}
+	}
+
+	limit := g.config.MaxResultRows + 1
+	db.Statement.AddClause(clause.Limit{Limit: &limit})
+	db.InstanceSet(cappedKey, true)
+}
+
+// capScannedRows caps the rows statement of a Scan as capResultRows
+func (g *sql) capScannedRows(db *gorm.DB) {
+	if scan, _ := db.Get(scanKey); scan == true {
+		g.capResultRows(db)
+	}
+}
+
+// checkResultRows fails the query capped by capResultRows with ErrResultRows if it
+// returned more than MaxResultRows rows, instead of a silently truncated result
+func (g *sql) checkResultRows(db *gorm.DB) {
+	if capped, _ := db.InstanceGet(cappedKey); capped != true || db.Error != nil {
+		return
+	}
+
+	if db.RowsAffected > int64(g.config.MaxResultRows) {
+		_ = db.AddError(ErrResultRows)
+	}
+}
+
+func (g *sql) audit(operation string) func(*gorm.DB) {
+	return func(db *gorm.DB) {
+		if db.Error != nil || db.DryRun {
+			return
+		}
+
+		g.emitAudit(db.Statement, operation, db.RowsAffected)
+	}
+}
+
+// emitAudit passes the event of the write of stmt to the audit sink, or holds it
+// until the commit of its transaction
+func (g *sql) emitAudit(stmt *gorm.Statement, operation string, rowsAffected int64) {
+	actor, _ := stmt.Settings.Load(AuditActorKey)
+
+	event := AuditEvent{
+		Table:        stmt.Table,
+		Operation:    operation,
+		Keys:         primaryKeys(stmt),
+		RowsAffected: rowsAffected,
+		Actor:        actor,
+	}
+
+	// the events of a transaction not opened by the wrapper can't be settled
+	if tx, ok := transactionOf(stmt.ConnPool); ok && g.audits.add(tx, event) {
+		return
+	}
+
+	g.auditSink(event)
+}
+
+// settleAudit passes the held events of the transaction to the audit sink if it's
+// committed, they are dropped otherwise
+func (g *sql) settleAudit(tx gorm.ConnPool, committed bool) {
+	if g.audits == nil || tx == nil {
+		return
+	}
+
+	for _, event := range g.audits.take(tx) {
+		if committed {
+			g.auditSink(event)
+		}
+	}
+}
+
+// open holds the events of the transaction until take
+func (b *auditBuffer) open(tx gorm.ConnPool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.events[tx] = []AuditEvent{}
+}
+
+// add holds the event if the transaction is open, it reports whether it's held
+func (b *auditBuffer) add(tx gorm.ConnPool, event AuditEvent) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	events, ok := b.events[tx]
+	if ok {
+		b.events[tx] = append(events, event)
+	}
+
+	return ok
+}
+
+// take removes the events of the transaction and returns them
+func (b *auditBuffer) take(tx gorm.ConnPool) []AuditEvent {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	events := b.events[tx]
+	delete(b.events, tx)
+
+	return events
+}
+
+// mark returns the count of the events held for the transaction
+func (b *auditBuffer) mark(tx gorm.ConnPool) int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	return len(b.events[tx])
+}
+
+// truncate drops the events held for the transaction after mark, e.g. of a nested
+// transaction rolled back to its savepoint
+func (b *auditBuffer) truncate(tx gorm.ConnPool, mark int) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if events := b.events[tx]; len(events) > mark {
+		b.events[tx] = events[:mark]
+	}
+}
+
+// transactionOf returns the transaction the pool runs on, if any
+func transactionOf(pool gorm.ConnPool) (gorm.ConnPool, bool) {
+	switch p := pool.(type) {
+	case simpleProtocolPool:
+		return transactionOf(p.ConnPool)
+	case *gorm.PreparedStmtTX:
+		return transactionOf(p.Tx)
+	}
+
+	_, ok := pool.(gorm.TxCommitter)
+	return pool, ok
+}
+
+// seqScans returns the filtered sequential scans of the node and its children
+func (n planNode) seqScans() []planNode {
+	var scans []planNode
+	if n.NodeType == "Seq Scan" && n.Filter != "" {
+		scans = append(scans, n)
+	}
+
+	for _, child := range n.Plans {
+		scans = append(scans, child.seqScans()...)
+	}
+
+	return scans
+}
+
+// primaryKeys returns the non-zero primary keys of the statement model(s)
+func primaryKeys(stmt *gorm.Statement) []interface{} {
+	if stmt.Schema == nil || stmt.Schema.PrioritizedPrimaryField == nil {
+		return nil
+	}
+
+	var (
+		field = stmt.Schema.PrioritizedPrimaryField
+		keys  []interface{}
+	)
+
+	switch stmt.ReflectValue.Kind() {
+	case reflect.Slice, reflect.Array:
+		for i := 0; i < stmt.ReflectValue.Len(); i++ {
+			if key, isZero := field.ValueOf(stmt.Context, stmt.ReflectValue.Index(i)); !isZero {
+				keys = append(keys, key)
+			}
+		}
+	case reflect.Struct:
+		if key, isZero := field.ValueOf(stmt.Context, stmt.ReflectValue); !isZero {
+			keys = append(keys, key)
+		}
+	}
+
+	return keys
+}
+
+// clone returns a new instance sharing the config of g and backed by db
+func (g *sql) clone(db *gorm.DB) *sql {
+	instance := *g
+	instance.db = db
+
+	return &instance
+}
+
+// session returns a handle with a fresh statement, bound to the current connection
+// (or transaction), for the helpers building their own query. the error of the
+// current chain stays on the chain
+func (g *sql) session() *gorm.DB {
+	db := g.db.Session(&gorm.Session{NewDB: true})
+	db.Error = nil
+
+	return db
+}
+
+// leaveTransaction binds the handle back to the connection pool once its
+// transaction is committed or rolled back
+func (g *sql) leaveTransaction() {
+	g.db.Statement.ConnPool = g.db.ConnPool
+}
+
+// fail adds err to the current chain, it never reaches the shared handle
+func (g *sql) fail(err error) abstraction.Sql {
+	g.db = g.db.Scopes() // a no-op, for the chain instance
+	_ = g.db.AddError(err)
+	return g
+}
+
+// finish keeps the finisher result as the current handle and drops the
+// chain-only modifiers, so they don't leak into the next queries
+func (g *sql) finish(db *gorm.DB) abstraction.Sql {
+	g.db = db
+	g.db.Statement.Unscoped = false
+	g.db.Statement.SkipHooks = false
+	g.db.Statement.Settings.Delete(preserveTimestampsKey)
+	g.db.Statement.Settings.Delete(uncappedKey)
+	g.db.Statement.Settings.Delete(scanKey)
+
+	if pool, ok := g.db.Statement.ConnPool.(simpleProtocolPool); ok {
+		g.db.Statement.ConnPool = pool.ConnPool
+	}
+
+	return g
+}
+
+// updateCapturing renders the update of db by a DryRun session and runs it as a Raw
+// query on the connection of db, as the query returns the updated rows
+func (g *sql) updateCapturing(db *gorm.DB, model interface{}, values interface{}, dest *[]map[string]interface{}) error {
+	render := db.Session(&gorm.Session{DryRun: true, SkipHooks: true}).
+		Set(capturingKey, true).
+		Model(model).
+		Clauses(clause.Returning{}).
+		Updates(values)
+	if render.Error != nil || g.config.DryRun {
+		return render.Error
+	}
+
+	// the update runs by gorm, for the error translation and the logger, as a Raw
+	// statement, which bypasses the update callbacks of the audit
+	update := db.Session(&gorm.Session{NewDB: true}).Raw(render.Statement.SQL.String(), render.Statement.Vars...).Scan(dest)
+	if update.Error != nil {
+		return update.Error
+	}
+
+	if g.auditSink != nil {
+		g.emitAudit(render.Statement, "update", update.RowsAffected)
+	}
+
+	return nil
+}
+
+// explainSlowQuery logs the sequential scans of the large tables in the plan of the
+// query, whose vars are bound as the args. it runs on the connection pool and
+// bypasses the callbacks
+func explainSlowQuery(pool gorm.ConnPool, log logger.Interface, query string, vars []interface{}) {
+	ctx, cancel := context.WithTimeout(context.Background(), explainTimeout)
+	defer cancel()
+
+	var plan string
+	if err := pool.QueryRowContext(ctx, "EXPLAIN (FORMAT JSON) "+query, vars...).Scan(&plan); err != nil {
+		log.Warn(ctx, "explain of the slow query failed: %v", err)
+		return
+	}
+
+	var plans []struct {
+		Plan planNode `json:"Plan"`
+	}
+
+	if err := json.Unmarshal([]byte(plan), &plans); err != nil {
+		log.Warn(ctx, "explain of the slow query failed: %v", err)
+		return
+	}
+
+	for _, p := range plans {
+		for _, scan := range p.Plan.seqScans() {
+			var rows float64
+			err := pool.QueryRowContext(ctx, "SELECT reltuples FROM pg_class WHERE oid = to_regclass($1)", scan.Relation).Scan(&rows)
+			if err != nil || rows < suggestIndexMinRows {
+				continue
+			}
+
+			log.Warn(ctx, "sequential scan on %s (~%.0f rows) filtered by %s, consider an index for: %s", scan.Relation, rows, scan.Filter, query)
+		}
+	}
+}
+
+// appendSelect adds the expression to the selected columns, after the columns or
+// the bound expression of the previous selects, whose vars are kept
+func (g *sql) appendSelect(expr string, args ...interface{}) {
+	var (
+		columns []string
+		vars    []interface{}
+	)
+
+	if c, ok := g.db.Statement.Clauses["SELECT"]; ok {
+		// a select with bound args is kept as the clause expression instead of Selects
+		if previous, isExpr := c.Expression.(clause.Expr); isExpr {
+			columns = append(columns, previous.SQL)
+			vars = append(vars, previous.Vars...)
+		}
+	}
+
+	if len(columns) == 0 {
+		columns = append(columns, g.db.Statement.Selects...)
+	}
+
+	columns = append(columns, expr)
+	vars = append(vars, args...)
+
+	g.db = g.db.Select(strings.Join(columns, ", "), vars...)
+}
+
+// exec runs the statement of a helper on a fresh statement, on DryRun the
+// rendered statement is printed instead
+func (g *sql) exec(query string, args ...interface{}) error {
+	if g.config.DryRun {
+		g.printDryRun(g.session().ToSQL(func(tx *gorm.DB) *gorm.DB {
+			return tx.Exec(query, args...)
+		}))
+
+		return nil
+	}
+
+	return g.session().Exec(query, args...).Error
+}
+
+func (g *sql) printDryRun(query string) {
+	fmt.Printf("%s;\n", strings.TrimRight(strings.TrimSpace(query), ";"))
+}
+
+// quoteIdentifier quotes the table or column name by the dialector, a schema
+// qualified name is quoted per part and the embedded quotes are escaped
+func (g *sql) quoteIdentifier(name string) string {
+	var builder strings.Builder
+	g.db.Dialector.QuoteTo(&builder, strings.TrimSpace(name))
+
+	return builder.String()
+}
+
+// filterCondition maps the filter to the condition of its operator
+func filterCondition(filter Filter) (clause.Expression, error) {
+	column := clause.Column{Name: filter.Field}
+
+	switch strings.ToLower(filter.Op) {
+	case "eq":
+		return clause.Eq{Column: column, Value: filter.Value}, nil
+	case "ne":
+		return clause.Neq{Column: column, Value: filter.Value}, nil
+	case "gt":
+		return clause.Gt{Column: column, Value: filter.Value}, nil
+	case "gte":
+		return clause.Gte{Column: column, Value: filter.Value}, nil
+	case "lt":
+		return clause.Lt{Column: column, Value: filter.Value}, nil
+	case "lte":
+		return clause.Lte{Column: column, Value: filter.Value}, nil
+	case "like":
+		return clause.Like{Column: column, Value: filter.Value}, nil
+	case "in":
+		values := reflect.ValueOf(filter.Value)
+		if values.Kind() != reflect.Slice && values.Kind() != reflect.Array {
+			return clause.IN{Column: column, Values: []interface{}{filter.Value}}, nil
+		}
+
+		in := clause.IN{Column: column, Values: make([]interface{}, 0, values.Len())}
+		for i := 0; i < values.Len(); i++ {
+			in.Values = append(in.Values, values.Index(i).Interface())
+		}
+
+		return in, nil
+	}
+
+	return nil, fmt.Errorf("%w: %s", ErrFilterOperator, filter.Op)
+}
+
+func contains(items []string, item string) bool {
+	for _, v := range items {
+		if v == item {
+			return true
+		}
+	}
+
+	return false
+}
+
+// quoteLiteral quotes the value as a sql string literal, for the statements
+// that don't accept the bound parameters
+func quoteLiteral(value string) string {
+	return "'" + strings.ReplaceAll(value, "'", "''") + "'"
+}
+
+// quoteIdentifiers quotes the names and joins them by comma
+func (g *sql) quoteIdentifiers(names []string) string {
+	quoted := make([]string, 0, len(names))
+	for _, name := range names {
+		quoted = append(quoted, g.quoteIdentifier(name))
+	}
+
+	return strings.Join(quoted, ", ")
+}
+
+// maintain runs the maintenance command on a dedicated connection of the pool,
+// VACUUM can't run inside a transaction even if g is bound to one
+func (g *sql) maintain(command string, tables []string) error {
+	if len(tables) > 0 {
+		command = fmt.Sprintf("%s %s", command, g.quoteIdentifiers(tables))
+	}
+
+	if g.config.DryRun {
+		g.printDryRun(command)
+		return nil
+	}
+
+	sqlDatabase, err := g.db.DB()
+	if err != nil {
+		return err
+	}
+
+	ctx := g.db.Statement.Context
+
+	conn, err := sqlDatabase.Conn(ctx)
+	if err != nil {
+		return err
+	}
+
+	defer conn.Close()
+
+	_, err = conn.ExecContext(ctx, command)
+	return err
+}
+
+// dialector returns the dialector of the Driver
+func (g *sql) dialector() (gorm.Dialector, error) {
+	dsn, err := g.dsn()
+	if err != nil {
+		return nil, err
+	}
+
+	switch g.driver() {
+	case "mysql":
+		return mysql.Open(dsn), nil
+	case "sqlite":
+		return sqlite.Open(dsn), nil
+	default:
+		return g.postgresDialector(dsn), nil
+	}
+}
+
+// dsn builds the data source name of the Driver by the connection configs
+func (g *sql) dsn() (string, error) {
+	switch g.driver() {
+	case "postgres":
+		return fmt.Sprintf(
+			"host=%s user=%s password=%s dbname=%s port=%s sslmode=%s",
+			g.config.Host,
+			g.config.Username,
+			g.config.Password,
+			g.config.Database,
+			g.config.Port,
+			g.config.Ssl,
+		), nil
+	case "mysql":
+		// the driver formats the dsn, the credentials may contain its delimiters
+		config := MysqlDriver.NewConfig()
+		config.User = g.config.Username
+		config.Passwd = g.config.Password
+		config.Net = "tcp"
+		config.Addr = net.JoinHostPort(g.config.Host, g.config.Port)
+		config.DBName = g.config.Database
+		config.ParseTime = true
+
+		return config.FormatDSN(), nil
+	case "sqlite":
+		return g.config.Database, nil
+	}
+
+	return "", fmt.Errorf("%w: %s", ErrUnknownDriver, g.config.Driver)
+}
+
+// driver returns the lower-cased Driver, postgres if it isn't configured
+func (g *sql) driver() string {
+	if g.config.Driver == "" {
+		return "postgres"
+	}
+
+	return strings.ToLower(g.config.Driver)
+}
+
+func (g *sql) postgresDialector(dsn string) gorm.Dialector {
+	if g.afterConnect == nil {
+		return postgres.Open(dsn)
+	}
+
+	connConfig, err := pgx.ParseConfig(dsn)
+	if err != nil {
+		helper.CustomPanic(g.locale.Get("sql_open_conn_err"), err)
+	}
+
+	return postgres.New(postgres.Config{
+		Conn: stdlib.OpenDB(*connConfig, stdlib.OptionAfterConnect(g.afterConnect)),
+	})
+}
+
+// connMaxLifetime returns MaxLifetimeSeconds randomized by MaxLifetimeJitterPercent.
+// database/sql applies a single lifetime to the whole pool, so the jitter spreads
+// the reconnections among the instances of the service. the percent is clamped to
+// maxLifetimeJitterPercent and the lifetime is a second at least, as a non-positive
+// lifetime never expires the connections
+func (g *sql) connMaxLifetime() time.Duration {
+	lifetime := time.Second * time.Duration(g.config.MaxLifetimeSeconds)
+	if g.config.MaxLifetimeJitterPercent <= 0 || lifetime <= 0 {
+		return lifetime
+	}
+
+	percent := g.config.MaxLifetimeJitterPercent
+	if percent > maxLifetimeJitterPercent {
+		percent = maxLifetimeJitterPercent
+	}
+
+	band := int64(lifetime) * int64(percent) / 100
+	jitter := rand.New(rand.NewSource(time.Now().UnixNano())).Int63n(2*band+1) - band
+
+	if randomized := lifetime + time.Duration(jitter); randomized > time.Second {
+		return randomized
+	}
+
+	return time.Second
+}
+
 func (g *sql) parseSqlFile(path string, fileInfo os.FileInfo) string {
 	sqlFile := fmt.Sprintf("%s/%s", path, fileInfo.Name())
 	sqlBytes, err := ioutil.ReadFile(sqlFile)
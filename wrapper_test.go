@@ -0,0 +1,853 @@
+package sqlwrapper
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	MysqlDriver "github.com/go-sql-driver/mysql"
+	"github.com/mindwingx/abstraction"
+	"gorm.io/driver/postgres"
+	"gorm.io/gorm"
+	"gorm.io/gorm/logger"
+)
+
+type (
+	// testLocale returns the keys as the messages
+	testLocale struct {
+		abstraction.Locale
+	}
+
+	testUser struct {
+		ID        uint
+		Name      string
+		CreatedAt time.Time
+		UpdatedAt time.Time
+		DeletedAt gorm.DeletedAt
+	}
+
+	testOwner struct {
+		ID   uint
+		Pets []testPet `gorm:"foreignKey:OwnerID"`
+	}
+
+	testPet struct {
+		ID      uint
+		OwnerID uint
+	}
+
+	testAccount struct {
+		ID    uint
+		Email string `gorm:"uniqueIndex"`
+	}
+
+	// testArchived is soft deleted into another column than deleted_at
+	testArchived struct {
+		ID         uint
+		ArchivedAt gorm.DeletedAt `gorm:"column:archived_at"`
+	}
+
+	// testEvent is stored in a table partitioned by created_at
+	testEvent struct {
+		ID        uint
+		Name      string
+		CreatedAt time.Time
+	}
+)
+
+func (testLocale) Get(key string) string {
+	return key
+}
+
+// newTestSql opens an instance on a sqlite database of its own
+func newTestSql(t *testing.T, config dbConfig, opts ...Option) *sql {
+	t.Helper()
+
+	config.Driver = "sqlite"
+	config.Database = filepath.Join(t.TempDir(), "test.db")
+	config.SkipDefaultTransaction = true
+
+	g := &sql{config: config, locale: testLocale{}, logger: logger.Discard}
+	for _, opt := range opts {
+		opt(g)
+	}
+
+	g.InitSql()
+	t.Cleanup(g.Close)
+
+	return g
+}
+
+// newDryRunPostgres renders the postgres statements without a server
+func newDryRunPostgres(t *testing.T) *sql {
+	t.Helper()
+
+	db, err := gorm.Open(postgres.New(postgres.Config{DSN: "host=localhost"}), &gorm.Config{
+		DryRun:                 true,
+		DisableAutomaticPing:   true,
+		SkipDefaultTransaction: true,
+		Logger:                 logger.Discard,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return &sql{db: db, locale: testLocale{}, logger: logger.Discard}
+}
+
+// dryRunTx stands for a transaction of a DryRun instance, whose statements don't run
+type dryRunTx struct {
+	gorm.ConnPool
+}
+
+func (dryRunTx) Commit() error   { return nil }
+func (dryRunTx) Rollback() error { return nil }
+
+// inDryRunTransaction binds the DryRun instance to a transaction
+func inDryRunTransaction(g *sql) *sql {
+	g.db = g.db.Session(&gorm.Session{NewDB: true})
+	g.db.Statement.ConnPool = dryRunTx{ConnPool: g.db.Statement.ConnPool}
+
+	return g
+}
+
+func migrateTest(t *testing.T, g *sql, models ...interface{}) {
+	t.Helper()
+
+	if err := g.session().AutoMigrate(models...); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestUnscopedAppliesToTheCurrentChainOnly(t *testing.T) {
+	g := newTestSql(t, dbConfig{})
+	migrateTest(t, g, &testUser{})
+
+	// the fixture is written on a handle of its own, off the chain under test
+	user := testUser{Name: "removed"}
+	if err := g.session().Create(&user).Error; err != nil {
+		t.Fatal(err)
+	}
+
+	if err := g.session().Delete(&user).Error; err != nil {
+		t.Fatal(err)
+	}
+
+	var unscoped []testUser
+	if err := g.Unscoped().Find(&unscoped).Error(); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(unscoped) != 1 {
+		t.Fatalf("Unscoped found %d users, want 1", len(unscoped))
+	}
+
+	var scoped []testUser
+	if err := g.Find(&scoped).Error(); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(scoped) != 0 {
+		t.Fatalf("the next query found %d users, want 0", len(scoped))
+	}
+}
+
+func TestSelectCaseKeepsThePreviousSelects(t *testing.T) {
+	g := newTestSql(t, dbConfig{})
+	migrateTest(t, g, &testUser{})
+
+	query := g.ToSQL(func(q abstraction.Sql) abstraction.Sql {
+		w := q.(*sql)
+		w.Model(&testUser{}).Select("id")
+		w.SelectCase([]Case{{When: "name = ?", Then: "'first'"}}, "", "first_case", "a")
+		w.SelectCase([]Case{{When: "name = ?", Then: "'second'"}}, "", "second_case", "b")
+		w.TimeBucket("created_at", "day", "day")
+
+		return w.Find(&[]map[string]interface{}{})
+	})
+
+	for _, want := range []string{"id", `name = "a"`, "first_case", `name = "b"`, "second_case", "date_trunc"} {
+		if !strings.Contains(query, want) {
+			t.Errorf("query %q misses %q", query, want)
+		}
+	}
+}
+
+func TestAuditEventsOfATransactionWaitForItsCommit(t *testing.T) {
+	var events []AuditEvent
+
+	g := newTestSql(t, dbConfig{}, WithAuditSink(func(event AuditEvent) {
+		events = append(events, event)
+	}))
+	migrateTest(t, g, &testUser{})
+
+	failed := errors.New("failed")
+	err := g.Transaction(func(tx abstraction.Sql) error {
+		if err := tx.Create(&testUser{Name: "rolled back"}).Error(); err != nil {
+			return err
+		}
+
+		return failed
+	})
+	if !errors.Is(err, failed) {
+		t.Fatal(err)
+	}
+
+	if len(events) != 0 {
+		t.Fatalf("a rolled back transaction emitted %d events", len(events))
+	}
+
+	err = g.Transaction(func(tx abstraction.Sql) error {
+		if err := tx.Create(&testUser{Name: "committed"}).Error(); err != nil {
+			return err
+		}
+
+		// the nested transaction is rolled back to its savepoint
+		_ = tx.(Sql).Transaction(func(nested abstraction.Sql) error {
+			_ = nested.Create(&testUser{Name: "nested"})
+			return failed
+		})
+
+		if len(events) != 0 {
+			t.Errorf("an open transaction emitted %d events", len(events))
+		}
+
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(events) != 1 || events[0].Operation != "create" {
+		t.Fatalf("the committed transaction emitted %+v, want the create", events)
+	}
+
+	tx := g.Begin()
+	tx.Create(&testUser{Name: "rolled back"})
+	tx.Rollback()
+
+	if len(events) != 1 {
+		t.Fatalf("Rollback emitted %d events", len(events)-1)
+	}
+
+	g.session().Create(&testUser{Name: "plain"})
+
+	if len(events) != 2 {
+		t.Fatalf("a write out of a transaction emitted %d events, want 1", len(events)-1)
+	}
+}
+
+func TestLimitWithTiesKeepsTheTieLimitAfterOffset(t *testing.T) {
+	g := newDryRunPostgres(t)
+
+	g.Model(&testUser{}).Order("name")
+	q := g.LimitWithTies(3).Offset(5).Find(&[]testUser{}).(*sql)
+	if err := q.db.Error; err != nil {
+		t.Fatal(err)
+	}
+
+	query := q.db.Statement.SQL.String()
+	if !strings.HasSuffix(query, "OFFSET 5 ROWS FETCH FIRST 3 ROWS WITH TIES") {
+		t.Fatalf("query %q misses the tie limit", query)
+	}
+}
+
+func TestLimitWithTiesFailsOnTheOtherDialects(t *testing.T) {
+	g := newTestSql(t, dbConfig{})
+	migrateTest(t, g, &testUser{})
+
+	g.Model(&testUser{}).Order("name")
+	err := g.LimitWithTies(3).Find(&[]testUser{}).Error()
+	if !errors.Is(err, ErrLimitWithTies) {
+		t.Fatalf("got %v, want ErrLimitWithTies", err)
+	}
+}
+
+func TestWithLockTimeoutRoundsUpToAMillisecond(t *testing.T) {
+	g := inDryRunTransaction(newDryRunPostgres(t))
+
+	q := g.WithLockTimeout(500 * time.Microsecond).(*sql)
+	if err := q.db.Error; err != nil {
+		t.Fatal(err)
+	}
+
+	if query := q.db.Statement.SQL.String(); query != "SET LOCAL lock_timeout = 1" {
+		t.Fatalf("got %q, want a 1ms lock timeout", query)
+	}
+
+	if err := inDryRunTransaction(newDryRunPostgres(t)).WithLockTimeout(0).Error(); !errors.Is(err, ErrLockTimeout) {
+		t.Fatalf("got %v, want ErrLockTimeout", err)
+	}
+}
+
+func TestWithLockTimeoutFailsOutOfATransaction(t *testing.T) {
+	err := newDryRunPostgres(t).WithLockTimeout(time.Second).Error()
+	if !errors.Is(err, gorm.ErrInvalidTransaction) {
+		t.Fatalf("got %v, want gorm.ErrInvalidTransaction", err)
+	}
+}
+
+func TestMaxResultRowsFailsTheUserQueriesOnly(t *testing.T) {
+	g := newTestSql(t, dbConfig{MaxResultRows: 2})
+	migrateTest(t, g, &testOwner{}, &testPet{})
+
+	owner := testOwner{Pets: make([]testPet, 5)}
+	if err := g.session().Create(&owner).Error; err != nil {
+		t.Fatal(err)
+	}
+
+	ids := []interface{}{}
+	for _, pet := range owner.Pets {
+		ids = append(ids, pet.ID)
+	}
+
+	existing, err := g.WhichExist(&testPet{}, "id", ids)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(existing) != len(ids) {
+		t.Errorf("WhichExist found %d of the %d pets", len(existing), len(ids))
+	}
+
+	var owners []testOwner
+	if err := g.Preload("Pets").Find(&owners).Error(); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(owners) != 1 || len(owners[0].Pets) != len(ids) {
+		t.Errorf("Preload loaded %+v, want the %d pets", owners, len(ids))
+	}
+
+	var pets []testPet
+	if err := g.Session().Find(&pets).Error(); !errors.Is(err, ErrResultRows) {
+		t.Errorf("got %v, want ErrResultRows", err)
+	}
+
+	pets = nil
+	if err := g.Session().Limit(2).Find(&pets).Error(); err != nil || len(pets) != 2 {
+		t.Errorf("a limited query got %d pets, %v", len(pets), err)
+	}
+
+	pets = nil
+	if err := g.Session().Model(&testPet{}).Scan(&pets).Error(); !errors.Is(err, ErrResultRows) {
+		t.Errorf("Scan got %v, want ErrResultRows", err)
+	}
+
+	pets = nil
+	if err := g.Session().Model(&testPet{}).Limit(2).Scan(&pets).Error(); err != nil || len(pets) != 2 {
+		t.Errorf("a limited Scan got %d pets, %v", len(pets), err)
+	}
+
+	rows, err := g.Session().Model(&testPet{}).Rows()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer rows.Close()
+
+	read := 0
+	for rows.Next() {
+		read++
+	}
+
+	if read != len(ids) {
+		t.Errorf("Rows read %d of the %d pets", read, len(ids))
+	}
+}
+
+func TestUpdateCapturingSetsTheUpdateTime(t *testing.T) {
+	g := newTestSql(t, dbConfig{})
+	migrateTest(t, g, &testUser{})
+
+	user := testUser{Name: "before"}
+	if err := g.session().Create(&user).Error; err != nil {
+		t.Fatal(err)
+	}
+
+	stale := time.Now().Add(-time.Hour)
+	if err := g.session().Model(&user).UpdateColumn("updated_at", stale).Error; err != nil {
+		t.Fatal(err)
+	}
+
+	var updated []map[string]interface{}
+	g.Where("id = ?", user.ID)
+	err := g.UpdateCapturing(&testUser{}, map[string]interface{}{"name": "after"}, &updated)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(updated) != 1 || updated[0]["name"] != "after" {
+		t.Fatalf("captured %+v, want the updated user", updated)
+	}
+
+	var reloaded testUser
+	if err := g.session().First(&reloaded, user.ID).Error; err != nil {
+		t.Fatal(err)
+	}
+
+	if !reloaded.UpdatedAt.After(stale.Add(time.Minute)) {
+		t.Fatalf("updated_at %v isn't set by the update", reloaded.UpdatedAt)
+	}
+}
+
+func TestWritesTargetThePartition(t *testing.T) {
+	created := time.Date(2024, 1, 15, 0, 0, 0, 0, time.UTC)
+
+	render := func(t *testing.T, write func(g *sql) abstraction.Sql) string {
+		q := write(newDryRunPostgres(t)).(*sql)
+		if err := q.db.Error; err != nil {
+			t.Fatal(err)
+		}
+
+		return q.db.Statement.SQL.String()
+	}
+
+	tests := []struct {
+		name  string
+		write func(g *sql) abstraction.Sql
+		want  []string
+	}{
+		{
+			name: "create",
+			write: func(g *sql) abstraction.Sql {
+				g.Partition("events_2024_01")
+				return g.Create(&testEvent{Name: "created", CreatedAt: created})
+			},
+			want: []string{`INSERT INTO "events_2024_01"`},
+		},
+		{
+			name: "upsert",
+			write: func(g *sql) abstraction.Sql {
+				g.Partition("events_2024_01")
+				return g.Upsert(&testEvent{ID: 1, Name: "upserted", CreatedAt: created}, "id", "created_at")
+			},
+			want: []string{`INSERT INTO "events_2024_01"`, `ON CONFLICT ("id","created_at") DO UPDATE SET "name"="excluded"."name"`},
+		},
+		{
+			name: "upsert by the primary keys",
+			write: func(g *sql) abstraction.Sql {
+				return g.Upsert(&testEvent{ID: 1, Name: "upserted", CreatedAt: created})
+			},
+			want: []string{`ON CONFLICT ("id") DO UPDATE`},
+		},
+		{
+			name: "delete",
+			write: func(g *sql) abstraction.Sql {
+				g.Partition("events_2024_01")
+				return g.Delete(&testEvent{}, 1)
+			},
+			want: []string{`DELETE FROM "events_2024_01" WHERE "events_2024_01"."id" = $1`},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			query := render(t, test.write)
+			for _, want := range test.want {
+				if !strings.Contains(query, want) {
+					t.Errorf("query %q misses %q", query, want)
+				}
+			}
+		})
+	}
+}
+
+func TestScopesAppliesEachScope(t *testing.T) {
+	g := newTestSql(t, dbConfig{})
+	migrateTest(t, g, &testUser{})
+
+	named := func(q abstraction.Query) abstraction.Sql {
+		return FromQuery(q).Where("name = ?", "scoped")
+	}
+	recent := func(q abstraction.Query) abstraction.Sql {
+		return FromQuery(q).Where("created_at > ?", "2024-01-01")
+	}
+
+	query := g.ToSQL(func(q abstraction.Sql) abstraction.Sql {
+		return q.(*sql).Scopes(named, recent).Find(&[]testUser{})
+	})
+
+	for _, want := range []string{`name = "scoped"`, `created_at > "2024-01-01"`} {
+		if !strings.Contains(query, want) {
+			t.Errorf("query %q misses %q", query, want)
+		}
+	}
+}
+
+func TestDsnOfEachDriver(t *testing.T) {
+	config := dbConfig{
+		Host:     "db.local",
+		Port:     "5432",
+		Username: "app",
+		Password: "secret",
+		Database: "app",
+		Ssl:      "disable",
+	}
+
+	tests := []struct {
+		driver string
+		want   string
+	}{
+		{driver: "", want: "host=db.local user=app password=secret dbname=app port=5432 sslmode=disable"},
+		{driver: "Postgres", want: "host=db.local user=app password=secret dbname=app port=5432 sslmode=disable"},
+		{driver: "mysql", want: "app:secret@tcp(db.local:5432)/app?parseTime=true"},
+		{driver: "sqlite", want: "app"},
+	}
+
+	for _, test := range tests {
+		config.Driver = test.driver
+
+		dsn, err := (&sql{config: config}).dsn()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if dsn != test.want {
+			t.Errorf("driver %q: got %q, want %q", test.driver, dsn, test.want)
+		}
+	}
+}
+
+func TestMysqlDsnEscapesTheCredentials(t *testing.T) {
+	config := dbConfig{Driver: "mysql", Host: "db.local", Port: "3306", Username: "app", Password: "p@ss:w/rd)?", Database: "app"}
+
+	dsn, err := (&sql{config: config}).dsn()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	parsed, err := MysqlDriver.ParseDSN(dsn)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if parsed.Passwd != config.Password || parsed.Addr != "db.local:3306" || parsed.DBName != "app" {
+		t.Fatalf("dsn %q parses to %+v", dsn, parsed)
+	}
+}
+
+func TestDsnOfAnUnknownDriver(t *testing.T) {
+	_, err := (&sql{config: dbConfig{Driver: "oracle"}}).dsn()
+	if !errors.Is(err, ErrUnknownDriver) {
+		t.Fatalf("got %v, want ErrUnknownDriver", err)
+	}
+}
+
+func TestMigrateSkipsTheAppliedFiles(t *testing.T) {
+	g := newTestSql(t, dbConfig{})
+
+	dir := t.TempDir()
+	for _, name := range []string{"1", "2", "3"} {
+		query := "CREATE TABLE table_" + name + " (id integer PRIMARY KEY)"
+		if err := os.WriteFile(filepath.Join(dir, name+".sql"), []byte(query), 0o600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var ran []string
+	g.OnMigrationProgress(func(file string, index, total int) {
+		ran = append(ran, file)
+	})
+
+	g.Migrate(dir)
+	if len(ran) != 3 {
+		t.Fatalf("the first pass applied %v, want the 3 files", ran)
+	}
+
+	ran = nil
+	g.Migrate(dir)
+	if len(ran) != 0 {
+		t.Fatalf("the second pass applied %v, want none", ran)
+	}
+
+	var recorded int64
+	if err := g.session().Table(migrationsTable).Count(&recorded).Error; err != nil {
+		t.Fatal(err)
+	}
+
+	if recorded != 3 {
+		t.Fatalf("%s records %d files, want 3", migrationsTable, recorded)
+	}
+}
+
+func TestCommitOutOfATransactionFailsTheChainOnly(t *testing.T) {
+	g := newTestSql(t, dbConfig{})
+	migrateTest(t, g, &testUser{})
+
+	// Begin binds the returned instance only, g stays out of the transaction
+	g.Begin()
+	if err := g.Create(&testUser{Name: "created"}).Error(); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := g.Commit().Error(); !errors.Is(err, gorm.ErrInvalidTransaction) {
+		t.Fatalf("got %v, want gorm.ErrInvalidTransaction", err)
+	}
+
+	var users []testUser
+	if err := g.Session().Find(&users).Error(); err != nil || len(users) != 1 {
+		t.Fatalf("a fresh session found %d users, %v", len(users), err)
+	}
+
+	tx := g.Begin()
+	if err := tx.Create(&testUser{Name: "committed"}).Error(); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := tx.Commit().Error(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestBeginAndWithContextStartAFreshStatement(t *testing.T) {
+	g := newTestSql(t, dbConfig{})
+	migrateTest(t, g, &testUser{})
+
+	if err := g.session().Create(&testUser{Name: "stored"}).Error; err != nil {
+		t.Fatal(err)
+	}
+
+	// a finished query leaves its conditions on g
+	g.Where("name = ?", "missing").Find(&[]testUser{})
+
+	var users []testUser
+	if err := g.WithContext(context.Background()).Find(&users).Error(); err != nil || len(users) != 1 {
+		t.Fatalf("WithContext found %d users, %v", len(users), err)
+	}
+
+	tx := g.Begin()
+	defer tx.Rollback()
+
+	users = nil
+	if err := tx.Find(&users).Error(); err != nil || len(users) != 1 {
+		t.Fatalf("Begin found %d users, %v", len(users), err)
+	}
+}
+
+func TestSessionsDontShareTheirConditions(t *testing.T) {
+	g := newTestSql(t, dbConfig{})
+	migrateTest(t, g, &testUser{})
+
+	const sessions = 50
+
+	users := make([]testUser, sessions)
+	for i := range users {
+		users[i].Name = fmt.Sprintf("user-%d", i)
+	}
+
+	if err := g.session().Create(&users).Error; err != nil {
+		t.Fatal(err)
+	}
+
+	var wg sync.WaitGroup
+	errs := make(chan error, sessions)
+
+	for i := 0; i < sessions; i++ {
+		wg.Add(1)
+
+		go func(i int) {
+			defer wg.Done()
+
+			name := fmt.Sprintf("user-%d", i)
+			base := []abstraction.Sql{g.Session(), g.WithContext(context.Background())}[i%2]
+
+			var found []testUser
+			if err := base.Where("name = ?", name).Where("id = ?", users[i].ID).Find(&found).Error(); err != nil {
+				errs <- err
+				return
+			}
+
+			if len(found) != 1 || found[0].Name != name {
+				errs <- fmt.Errorf("%s found %+v", name, found)
+			}
+		}(i)
+	}
+
+	wg.Wait()
+	close(errs)
+
+	for err := range errs {
+		t.Error(err)
+	}
+}
+
+func TestAuditEventsOfTheInternalTransactionsReachTheSink(t *testing.T) {
+	var events []AuditEvent
+
+	g := newTestSql(t, dbConfig{}, WithAuditSink(func(event AuditEvent) {
+		events = append(events, event)
+	}))
+	migrateTest(t, g, &testOwner{}, &testPet{})
+
+	owner := testOwner{Pets: make([]testPet, 2)}
+	if err := g.session().Create(&owner).Error; err != nil {
+		t.Fatal(err)
+	}
+
+	events = nil
+	if err := g.ReplaceAssociation(&owner, "Pets", []testPet{{}, {}}); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(events) == 0 {
+		t.Error("ReplaceAssociation emitted no events")
+	}
+
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "1.sql"), []byte("CREATE TABLE migrated (id integer)"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	events = nil
+	g.Migrate(dir)
+
+	if len(events) != 1 || events[0].Table != migrationsTable {
+		t.Errorf("Migrate emitted %+v, want the %s insert", events, migrationsTable)
+	}
+
+	if len(g.audits.events) != 0 {
+		t.Fatalf("%d transactions are left in the audit buffer", len(g.audits.events))
+	}
+}
+
+func TestAuditEventsOfACommitFollowTheCommitOnly(t *testing.T) {
+	var events []AuditEvent
+
+	g := newTestSql(t, dbConfig{}, WithAuditSink(func(event AuditEvent) {
+		events = append(events, event)
+	}))
+	migrateTest(t, g, &testUser{})
+
+	tx := g.Begin()
+	tx.Create(&testUser{Name: "committed"})
+
+	// an earlier error of the chain doesn't undo the commit
+	tx.(Sql).ApplySort("bogus", []string{"name"})
+	tx.Commit()
+
+	var count int64
+	if err := g.session().Model(&testUser{}).Count(&count).Error; err != nil || count != 1 {
+		t.Fatalf("committed %d users, %v", count, err)
+	}
+
+	if len(events) != 1 {
+		t.Fatalf("the commit emitted %d events, want 1", len(events))
+	}
+}
+
+func TestUpdateCapturingRunsThroughGorm(t *testing.T) {
+	var events []AuditEvent
+
+	g := newTestSql(t, dbConfig{TranslateError: true}, WithAuditSink(func(event AuditEvent) {
+		events = append(events, event)
+	}))
+	migrateTest(t, g, &testAccount{})
+
+	accounts := []testAccount{{Email: "a@example.com"}, {Email: "b@example.com"}}
+	if err := g.session().Create(&accounts).Error; err != nil {
+		t.Fatal(err)
+	}
+
+	events = nil
+
+	var updated []map[string]interface{}
+	g.Where("id = ?", accounts[1].ID)
+	err := g.UpdateCapturing(&testAccount{}, map[string]interface{}{"email": "c@example.com"}, &updated)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(events) != 1 || events[0].Operation != "update" || events[0].RowsAffected != 1 {
+		t.Fatalf("the update emitted %+v, want an update of a row", events)
+	}
+
+	g.Where("id = ?", accounts[1].ID)
+	err = g.UpdateCapturing(&testAccount{}, map[string]interface{}{"email": "a@example.com"}, &updated)
+	if !errors.Is(err, gorm.ErrDuplicatedKey) {
+		t.Fatalf("got %v, want gorm.ErrDuplicatedKey", err)
+	}
+}
+
+func TestDeferConstraintsRunsInATransactionOnly(t *testing.T) {
+	err := newDryRunPostgres(t).DeferConstraints().Error()
+	if !errors.Is(err, gorm.ErrInvalidTransaction) {
+		t.Fatalf("got %v, want gorm.ErrInvalidTransaction", err)
+	}
+
+	q := inDryRunTransaction(newDryRunPostgres(t)).DeferConstraints().(*sql)
+	if err := q.db.Error; err != nil {
+		t.Fatal(err)
+	}
+
+	if query := q.db.Statement.SQL.String(); query != "SET CONSTRAINTS ALL DEFERRED" {
+		t.Fatalf("got %q", query)
+	}
+}
+
+func TestConnMaxLifetimeStaysPositive(t *testing.T) {
+	g := &sql{config: dbConfig{MaxLifetimeSeconds: 10, MaxLifetimeJitterPercent: 150}}
+
+	for i := 0; i < 1000; i++ {
+		lifetime := g.connMaxLifetime()
+		if lifetime < time.Second || lifetime > 20*time.Second {
+			t.Fatalf("lifetime %v is out of [1s, 20s)", lifetime)
+		}
+	}
+
+	if lifetime := (&sql{config: dbConfig{MaxLifetimeJitterPercent: 50}}).connMaxLifetime(); lifetime != 0 {
+		t.Fatalf("an unlimited lifetime is randomized to %v", lifetime)
+	}
+}
+
+func TestLastSQLIsKeptPerInstance(t *testing.T) {
+	g := newTestSql(t, dbConfig{})
+	migrateTest(t, g, &testUser{})
+
+	first, second := g.Session(), g.WithContext(context.Background())
+	first.Where("name = ?", "first").Find(&[]testUser{})
+	second.Where("name = ?", "second").Find(&[]testUser{})
+
+	for instance, want := range map[abstraction.Sql]string{first: "first", second: "second"} {
+		query, args := instance.(Sql).LastSQL()
+		if !strings.Contains(query, "name = ?") || len(args) != 1 || args[0] != want {
+			t.Errorf("LastSQL returned %q %v, want the %s query", query, args, want)
+		}
+	}
+
+	row := g.Session().Model(&testUser{}).Select("count(*)")
+	row.Row()
+
+	if query, _ := row.(Sql).LastSQL(); !strings.Contains(query, "count(*)") {
+		t.Errorf("LastSQL returned %q, want the Row query", query)
+	}
+}
+
+func TestPurgeTrashedResolvesTheSoftDeleteColumn(t *testing.T) {
+	g := newTestSql(t, dbConfig{})
+	migrateTest(t, g, &testArchived{}, &testPet{})
+
+	archived := []testArchived{{}, {}}
+	if err := g.session().Create(&archived).Error; err != nil {
+		t.Fatal(err)
+	}
+
+	if err := g.session().Delete(&archived[0]).Error; err != nil {
+		t.Fatal(err)
+	}
+
+	purged, err := g.PurgeTrashed(&testArchived{}, time.Now().Add(time.Minute))
+	if err != nil || purged != 1 {
+		t.Fatalf("purged %d rows, %v, want the archived row", purged, err)
+	}
+
+	if _, err := g.PurgeTrashed(&testPet{}, time.Now()); !errors.Is(err, ErrNotSoftDeleted) {
+		t.Fatalf("got %v, want ErrNotSoftDeleted", err)
+	}
+}